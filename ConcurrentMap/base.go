@@ -1,5 +1,7 @@
 package concurrentMap
 
+import "time"
+
 
 const(
 
@@ -18,4 +20,24 @@ const(
 const (
 	// MAX_CONCURRENCY 代表最大并发量。
 	MAX_CONCURRENCY int = 65536
-)
\ No newline at end of file
+)
+
+const (
+	// DEFAULT_SWEEP_INTERVAL 代表清理过期键-元素对的默认时间间隔。
+	DEFAULT_SWEEP_INTERVAL time.Duration = time.Second
+
+	// TTL_NO_EXPIRY 代表TTLRemaining对没有过期时间的键返回的剩余时长。
+	TTL_NO_EXPIRY time.Duration = -1
+)
+
+const (
+	// MOVE_TO_FRONT_MAX_DEPTH 代表WithMoveToFrontOnGet会移动的键-元素对在链表中的最大位置（从0开始）。
+	// 移动需要复制它之前的所有键-元素对，限制位置可以让每次读取的分配次数不超过这个值。
+	MOVE_TO_FRONT_MAX_DEPTH int = 8
+)
+
+const (
+	// DEFAULT_COMPACT_WATERMARK 代表收缩散列段的低水位。
+	// 当散列段的键-元素对总数低于散列桶数量与它的乘积时，Compact才会收缩散列桶。
+	DEFAULT_COMPACT_WATERMARK float64 = 0.25
+)
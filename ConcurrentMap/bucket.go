@@ -4,22 +4,42 @@ import (
 	"bytes"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // 并发安全的散列桶接口
+//
+// Put、PutIfAbsent、Delete和Clear都会在获取锁之后才读取表头。
+// lock为nil时它们会使用散列桶自己的互斥锁，因此总是可以被并发调用；
+// 传入lock则可以让多个散列桶共用同一把锁。
 type Bucket interface {
 	// put放入一个键 - 元素元素，调用此方法前lock了这里就不要把lock传入
 	Put(p Pair, lock sync.Locker) (bool, error)
 
-	// 获取指定 键 - 元素 对
+	// 仅在键不存在或已过期时放入键 - 元素对，返回true代表p被放入。
+	// 键已存在且未过期时不会改动原有元素；替换已过期的键 - 元素对时尺寸不变
+	PutIfAbsent(p Pair, lock sync.Locker) (bool, error)
+
+	// 获取指定 键 - 元素 对，它不会加锁，
+	// 因此可以在持有读锁或不持有任何锁的情况下与Put和Delete并发调用。
+	// 链表中的键 - 元素对一旦可见就不会再被改动，写操作总是写时复制
 	Get(key string) Pair
 
 	// 返回第一个键 - 元素对
 	GetFirstPair() Pair
 
-	// 删除指定的 键 - 元素 对
+	// 返回当前所有键 - 元素对的快照，调用方无需关心占位符
+	Pairs() []Pair
+
+	// 删除指定的 键 - 元素 对，它会复制目标之前的所有键 - 元素对，
+	// 因此耗时和分配次数都与目标在链表中的位置成正比
 	Delete(key string, lock sync.Locker) bool
 
+	// 把链表中的p移到表头并返回取代它的副本，p已在表头时返回p。
+	// 它只在能立即获取散列桶自己的锁、并且p的位置不超过MOVE_TO_FRONT_MAX_DEPTH时才移动，
+	// 否则以及p已不在链表中时返回nil，因此每次移动最多复制MOVE_TO_FRONT_MAX_DEPTH个键 - 元素对
+	MoveToFront(p Pair) Pair
+
 	//清空散列桶
 	Clear(lock sync.Locker)
 
@@ -35,36 +55,92 @@ type bucket struct {
 	// 键- 元素 对列表的表头
 	firstValue atomic.Value
 	size       uint64
+	// 未传入外部锁时使用的互斥锁，它可能由多个散列桶共用
+	lock *sync.Mutex
+	// 比较键的函数，nil代表使用==
+	equals func(a, b string) bool
+	// 判断键 - 元素对是否过期时使用的时钟，nil代表使用time.Now
+	clock func() time.Time
 }
 
-func (b *bucket) Put(p Pair, lock sync.Locker) (bool, error) {
-	if p == nil {
-		return false, newIllegalParameterError("pair is nil")
+// now 返回散列桶的时钟给出的当前时刻（Unix纳秒）
+func (b *bucket) now() int64 {
+	if b.clock == nil {
+		return time.Now().UnixNano()
 	}
+	return b.clock().UnixNano()
+}
+
+// locker 返回写操作要使用的锁，lock为nil时返回散列桶自己的互斥锁
+func (b *bucket) locker(lock sync.Locker) sync.Locker {
 	if lock != nil {
-		lock.Lock()
-		defer lock.Unlock()
+		return lock
+	}
+	return b.lock
+}
+
+func (b *bucket) Put(p Pair, lock sync.Locker) (bool, error) {
+	if p == nil {
+		return false, newIllegalParameterErrorWithCause(ErrNilPair, "pair is nil")
 	}
+	l := b.locker(lock)
+	l.Lock()
+	defer l.Unlock()
 	firstPair := b.GetFirstPair()
 	if firstPair == nil {
-		b.firstValue.Store(p)
+		// 清除p可能残留的next，以免复活已被删除的键 - 元素对
+		p.SetNext(nil)
+		setVersion(p, nil)
+		b.setHead(p)
 		atomic.AddUint64(&b.size, 1)
 		return true, nil
 	}
 	var target Pair
 	key := p.Key()
 	for v := firstPair; v != nil; v = v.Next() {
-		if v.Key() == key {
+		if keysEqual(b.equals, v.Key(), key) {
 			target = v
 			break
 		}
 	}
 	if target != nil {
-		target.SetElement(p.Element())
+		// 写时复制：用p替换target，原有的链表保持不变
+		setVersion(p, target)
+		p.SetNext(target.Next())
+		b.setHead(relink(firstPair, target, p))
 		return false, nil
 	}
+	setVersion(p, nil)
+	p.SetNext(firstPair)
+	b.setHead(p)
+	atomic.AddUint64(&b.size, 1)
+	return true, nil
+}
+
+func (b *bucket) PutIfAbsent(p Pair, lock sync.Locker) (bool, error) {
+	if p == nil {
+		return false, newIllegalParameterErrorWithCause(ErrNilPair, "pair is nil")
+	}
+	l := b.locker(lock)
+	l.Lock()
+	defer l.Unlock()
+	firstPair := b.GetFirstPair()
+	for v := firstPair; v != nil; v = v.Next() {
+		if !keysEqual(b.equals, v.Key(), p.Key()) {
+			continue
+		}
+		if !isExpired(v, b.now()) {
+			return false, nil
+		}
+		// 已过期的键 - 元素对被视为不存在，写时复制地用p取代它
+		setVersion(p, nil)
+		p.SetNext(v.Next())
+		b.setHead(relink(firstPair, v, p))
+		return true, nil
+	}
+	setVersion(p, nil)
 	p.SetNext(firstPair)
-	b.firstValue.Store(p)
+	b.setHead(p)
 	atomic.AddUint64(&b.size, 1)
 	return true, nil
 }
@@ -75,7 +151,7 @@ func (b *bucket) Get(key string) Pair {
 		return nil
 	}
 	for v := firstPair; v != nil; v = v.Next() {
-		if v.Key() == key {
+		if keysEqual(b.equals, v.Key(), key) {
 			return v
 		}
 	}
@@ -83,60 +159,80 @@ func (b *bucket) Get(key string) Pair {
 }
 
 func (b *bucket) GetFirstPair() Pair {
-	if v := b.firstValue.Load(); v == nil {
+	p, _ := b.firstValue.Load().(Pair)
+	if isEmpty(p) {
 		return nil
-	} else if p, ok := v.(Pair); !ok || p == placeholder {
-		return nil
-	} else {
-		return p
 	}
+	return p
 }
 
-func (b *bucket) Delete(key string, lock sync.Locker) bool {
-	if lock != nil {
-		lock.Lock()
-		defer lock.Unlock()
+func (b *bucket) Pairs() []Pair {
+	pairs := make([]Pair, 0, b.Size())
+	for v := b.GetFirstPair(); v != nil; v = v.Next() {
+		pairs = append(pairs, v)
 	}
+	return pairs
+}
+
+func (b *bucket) Delete(key string, lock sync.Locker) bool {
+	l := b.locker(lock)
+	l.Lock()
+	defer l.Unlock()
 	firstPair := b.GetFirstPair()
 	if firstPair == nil {
 		return false
 	}
-	var prevPairs []Pair
+	// 写时复制：复制目标之前的键 - 元素对并让它们指向目标之后的部分，
+	// 原有的链表保持不变，正在遍历的读操作和快照仍能看到删除前的内容。
+	// 代价是删除第k个键 - 元素对需要k-1次分配，原地摘除时删除不分配内存，
+	// 这里为了无锁读取和廉价的Snapshot放弃了它，链表的长度由再分布器限制
+	// （见BenchmarkBucketDelete）
 	var target Pair
-	var breakpoint Pair
 	for v := firstPair; v != nil; v = v.Next() {
-		if v.Key() == key {
+		if keysEqual(b.equals, v.Key(), key) {
 			target = v
-			breakpoint = v.Next()
 			break
 		}
-		prevPairs = append(prevPairs, v)
 	}
 	if target == nil {
 		return false
 	}
-	newFirstPair := breakpoint
-	for i := len(prevPairs) - 1; i >= 0; i-- {
-		pairCopy := prevPairs[i].Copy()
-		pairCopy.SetNext(newFirstPair)
-		newFirstPair = pairCopy
-	}
-	if newFirstPair != nil {
-		b.firstValue.Store(newFirstPair)
-	} else {
-		b.firstValue.Store(placeholder)
-	}
+	b.setHead(relink(firstPair, target, target.Next()))
+	// 目标是在持有锁之后才找到的，同一个键的并发Delete中只有一个能走到这里，
+	// 因此size不会因重复删除而下溢
 	atomic.AddUint64(&b.size, ^uint64(0))
 	return true
 }
 
-func (b *bucket) Clear(lock sync.Locker) {
-	if lock != nil {
-		lock.Lock()
-		defer lock.Unlock()
+func (b *bucket) MoveToFront(p Pair) Pair {
+	if !b.lock.TryLock() {
+		return nil
+	}
+	defer b.lock.Unlock()
+	firstPair := b.GetFirstPair()
+	if firstPair == p {
+		return p
 	}
+	depth := 0
+	for v := firstPair; v != nil && depth <= MOVE_TO_FRONT_MAX_DEPTH; v = v.Next() {
+		depth++
+		if v == p && v.Key() == p.Key() {
+			// 写时复制：让p的副本指向去掉p之后的链表，原有的链表保持不变
+			np := p.Copy()
+			np.SetNext(relink(firstPair, p, p.Next()))
+			b.setHead(np)
+			return np
+		}
+	}
+	return nil
+}
+
+func (b *bucket) Clear(lock sync.Locker) {
+	l := b.locker(lock)
+	l.Lock()
+	defer l.Unlock()
 	atomic.StoreUint64(&b.size, 0)
-	b.firstValue.Store(placeholder)
+	b.setEmpty()
 }
 
 func (b *bucket) Size() uint64 {
@@ -154,11 +250,77 @@ func (b *bucket) String() string {
 	return buf.String()
 }
 
+// relink 会复制从first开始直到target之前的键 - 元素对，
+// 并让最后一个副本指向tail，然后返回新的表头。
+// first之后的链表不会被改动，因此已经被读到的表头始终代表不变的内容
+func relink(first, target, tail Pair) Pair {
+	var head, last Pair
+	for v := first; v != target; v = v.Next() {
+		c := v.Copy()
+		if last == nil {
+			head = c
+		} else {
+			last.SetNext(c)
+		}
+		last = c
+	}
+	if last == nil {
+		return tail
+	}
+	last.SetNext(tail)
+	return head
+}
+
+// placeholder 是空散列桶的表头。atomic.Value不能存储nil，因此空链表由它代表；
+// 除了setEmpty、setHead和isEmpty之外的代码都不应直接使用它
 var placeholder Pair = &pair{}
 
+// setEmpty 会把散列桶的表头设为代表空链表的占位符
+func (b *bucket) setEmpty() {
+	b.firstValue.Store(placeholder)
+}
+
+// setHead 会把散列桶的表头设为head，head为nil时设为占位符
+func (b *bucket) setHead(head Pair) {
+	if head == nil {
+		b.setEmpty()
+		return
+	}
+	b.firstValue.Store(head)
+}
+
+// isEmpty 判断表头head是否代表空链表，占位符永远不会出现在链表的中间
+func isEmpty(head Pair) bool {
+	return head == nil || head == placeholder
+}
+
 // newBucket 会创建一个Bucket类型的实例。
 func newBucket() Bucket {
-	b := &bucket{}
-	b.firstValue.Store(placeholder)
+	return newBucketWithLock(&sync.Mutex{})
+}
+
+// newBucketWithLock 会创建一个未传入外部锁时使用lock的Bucket类型的实例，
+// 多个散列桶可以共用同一个lock以节省内存。
+func newBucketWithLock(lock *sync.Mutex) Bucket {
+	return newBucketWithKeyEquals(lock, nil)
+}
+
+// newBucketWithKeyEquals 会创建一个用equals比较键的Bucket类型的实例，equals为nil时使用==。
+func newBucketWithKeyEquals(lock *sync.Mutex, equals func(a, b string) bool) Bucket {
+	return newBucketWithClock(lock, equals, nil)
+}
+
+// newBucketWithClock 会创建一个用equals比较键、用clock判断过期的Bucket类型的实例，clock为nil时使用time.Now。
+func newBucketWithClock(lock *sync.Mutex, equals func(a, b string) bool, clock func() time.Time) Bucket {
+	b := &bucket{lock: lock, equals: equals, clock: clock}
+	b.setEmpty()
 	return b
 }
+
+// keysEqual 用equals比较两个键，equals为nil时使用==
+func keysEqual(equals func(a, b string) bool, a, b string) bool {
+	if equals == nil {
+		return a == b
+	}
+	return equals(a, b)
+}
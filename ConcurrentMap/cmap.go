@@ -1,17 +1,282 @@
 package concurrentMap
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConcurrentMap interface {
 	//并发量
 	Concurrency() int
-	Put(key string, element interface{}) (bool, error)
+	// Put 放入键-元素对，isNew为true代表新增了键，为false代表覆盖了原有元素
+	Put(key string, element interface{}) (isNew bool, err error)
+	// TryPut 在不需要等待散列段的锁时放入p的键和元素，否则立即返回ok为false。
+	// ok为false代表锁正被占用、稍后可以重试，而不是永久性的失败；
+	// 只有p为nil时ok才会因为其他原因为false
+	TryPut(p Pair) (ok bool, inserted bool)
+	// BatchPut 放入多个键-元素对，每个散列段只加锁一次，
+	// 返回新增（而非覆盖）的数量。
+	// 若其中存在nil则不会放入任何键-元素对并返回错误
+	BatchPut(pairs []Pair) (inserted int, err error)
+	// PutAll 把普通字典中的键-元素对全部放入，按散列段分组以减少加锁次数。
+	// 它会尽力放入所有合法的键-元素对，并在返回的错误中汇总所有失败的键
+	PutAll(m map[string]interface{}) error
+	// PutIfAbsent 仅在键不存在时放入键-元素对，已过期的键视为不存在，
+	// 若键已存在则不会改动原有元素并返回false
+	PutIfAbsent(key string, element interface{}) (bool, error)
+	// PutWithTTL 放入一个在ttl之后过期的键-元素对，
+	// 过期的键-元素对会被视为不存在并由后台清理协程删除
+	PutWithTTL(key string, element interface{}, ttl time.Duration) (bool, error)
+	// TTLRemaining 返回键距离过期的剩余时长，键不存在或已过期时ok为false。
+	// 键没有过期时间时返回TTL_NO_EXPIRY。它不算作一次访问，不会刷新过期时间
+	TTLRemaining(key string) (remaining time.Duration, ok bool)
+	// Get 返回键对应的元素，键不存在和元素为nil时都返回nil，需要区分两者时使用Load
 	Get(key string) interface{}
+	// TryGet 在不需要等待散列段的锁时返回键对应的元素以及键是否存在，
+	// 否则立即返回acquired为false。它不会删除已过期的键-元素对，也不会更新LRU顺序，
+	// 因此永远不会阻塞
+	TryGet(key string) (element interface{}, ok bool, acquired bool)
+	// Load 返回键对应的元素以及键是否存在，语义与sync.Map的Load一致，
+	// 是读取元素时推荐使用的方法
+	Load(key string) (element interface{}, ok bool)
+	// GetAll 返回keys中存在的键到其元素的映射，不存在或已过期的键不会出现在结果中。
+	// 键按散列段分组，每个散列段只加一次读锁
+	GetAll(keys []string) map[string]interface{}
+	// GetAllWithMissing 与GetAll相同，并按keys中的顺序返回不存在的键
+	GetAllWithMissing(keys []string) (found map[string]interface{}, missing []string)
+	// GetWithVersion 与Load相同，并返回键当前的版本号。
+	// 版本号由键所在的散列段分配，Put、Replace、Compute等每次写入都会让它变大，但不保证连续；
+	// 键被删除后再放入也不会重复使用以前的版本号，因此不存在ABA问题
+	GetWithVersion(key string) (element interface{}, version uint64, ok bool)
+	// PutIfVersion 仅在键当前的版本号等于expectedVersion时放入元素，返回是否放入。
+	// expectedVersion为0代表要求键不存在，存在的键的版本号总是大于0
+	PutIfVersion(key string, element interface{}, expectedVersion uint64) bool
+	// Contains 判断键是否存在，已过期的键视为不存在
+	Contains(key string) bool
+	// GetOrPut 在键存在时返回已有元素且loaded为true，已过期的键视为不存在，
+	// 否则放入newElement的结果并返回之，loaded为false。
+	// newElement只会在真正放入时被调用，它返回的nil同样会作为元素放入，之后Load会得到(nil, true)
+	GetOrPut(key string, newElement func() interface{}) (actual interface{}, loaded bool)
+	// GetOrCompute 在键存在时返回已有元素，否则在锁外调用compute并放入它的结果。
+	// 同一个键的并发调用中compute最多只会被执行一次，其余调用方等待并得到相同的结果。
+	// compute返回错误时不会放入任何元素，所有等待者都得到该错误；
+	// compute引发panic时它在执行compute的协程中继续传播，等待者得到CallbackPanicError
+	GetOrCompute(key string, compute func() (interface{}, error)) (interface{}, error)
+	// WaitFor 在键存在时立即返回它的元素，否则阻塞直到键被放入或ctx结束，后者返回ctx.Err()。
+	// 覆盖已有的键同样会唤醒等待者，ctx结束时等待者会被撤销，不会残留在字典中
+	WaitFor(ctx context.Context, key string) (interface{}, error)
+	// Compute 在散列段的锁内原子地读取键对应的元素并调用f，
+	// 然后根据f的返回值存储新元素或在delete为true时删除该键。
+	// 键不存在且delete为false时会插入新元素
+	Compute(key string, f func(old interface{}, exists bool) (new interface{}, delete bool)) error
+	// Replace 仅在键存在时替换其元素并返回true，键不存在时什么也不做并返回false
+	Replace(key string, element interface{}) (replaced bool)
+	// CompareAndSwap 仅在当前元素与old相等时把它替换为new并返回true。
+	// eq为nil时使用==比较，此时若元素的类型不可比较会引发panic
+	CompareAndSwap(key string, old, new interface{}, eq func(a, b interface{}) bool) bool
+	// CompareAndDelete 仅在当前元素与old相等时删除该键并返回true，
+	// eq的约定与CompareAndSwap相同
+	CompareAndDelete(key string, old interface{}, eq func(a, b interface{}) bool) bool
+	// Update 原子地更新多个键：它按散列段的索引从小到大依次获取所涉及散列段的写锁，
+	// 因此并发的Update之间不会死锁。持有全部锁之后，它把keys中存在的键及其元素传给f，
+	// 再把f返回的键-元素对写回，最后才释放所有锁。
+	// 返回值中不属于keys的键会被忽略，keys中未出现在返回值里的键保持不变。
+	// f在锁内被调用，因此不能访问当前字典
+	Update(keys []string, f func(snapshot map[string]interface{}) map[string]interface{}) error
+	// Rename 原子地把oldKey的元素移到newKey下，过期时间保持不变。
+	// 它与Update一样按散列段的索引从小到大获取所涉及散列段的写锁。
+	// oldKey不存在，或者newKey已存在而overwrite为false时返回false，字典不会被改动。
+	// 对oldKey而言它与Delete一样会触发WithEvictionCallback设置的回调，被覆盖的newKey的元素也是如此
+	Rename(oldKey, newKey string, overwrite bool) (bool, error)
+	// Transaction 调用fn并在它返回nil时原子地应用它通过tx缓存的全部写操作，返回错误时丢弃它们。
+	// 提交时按散列段的索引从小到大获取所涉及散列段的写锁，因此与Update之间不会死锁。
+	// 获取散列段锁的操作（例如Snapshot和Update）对每个散列段要么看到全部提交的写操作，要么一个也看不到；
+	// Get等无锁读取的每个键都是原子地改变的，但在提交期间可能看到一部分键已改变而另一部分尚未改变。
+	// fn中通过tx读取的值不会被锁定，提交时也不会检查它们是否已被其他写操作改变
+	Transaction(fn func(tx Tx) error) error
+	// DrainAll 依次获取全部散列段的写锁，把每个散列段换成同样数量的空散列桶，
+	// 然后以普通字典的形式返回原有的全部未过期键-元素对，总数会归零。
+	// 获取全部锁之后的写操作都会作用于新的散列桶，因此不会有键被遗漏或重复返回
+	DrainAll() map[string]interface{}
+	// Increment 在锁内把键对应的int64元素加上delta并返回新的值，键不存在时视为0。
+	// 已有元素不是int64时不会改动它，并返回以ErrUnexpectedElementType为原因的IllegalParameterError
+	Increment(key string, delta int64) (int64, error)
+	// Append 在锁内把values追加到键对应的[]interface{}元素之后，键不存在时视为空切片。
+	// 追加总是作用于新的切片，之前读到旧切片的调用方不会看到变化。
+	// 已有元素不是[]interface{}时不会改动它，并返回以ErrUnexpectedElementType为原因的IllegalParameterError
+	Append(key string, values ...interface{}) error
+	// ComputeWithRetry 以乐观的方式更新键对应的元素：它在锁外读取元素和版本号并调用f，
+	// 再用PutIfVersion写回f的结果，版本号已被其他写操作改变时重新读取并重试，
+	// 最多重试maxRetries次，之后返回RetriesExhaustedError。
+	// 与Compute不同，f不在锁内被调用，因此可能被调用多次
+	ComputeWithRetry(key string, maxRetries int, f func(old interface{}, exists bool) interface{}) (interface{}, error)
+	// Swap 存储element并返回之前的元素，键不存在时插入element并返回(nil, false)
+	Swap(key string, element interface{}) (previous interface{}, loaded bool)
+	// LoadAndDelete 在散列段的锁内删除键并返回被删除的元素，键不存在时返回(nil, false)
+	LoadAndDelete(key string) (element interface{}, loaded bool)
 	Delete(key string) bool
+	// BatchDelete 删除多个键，每个散列段只加锁一次，
+	// 返回实际删除的数量，不存在的键会被忽略
+	BatchDelete(keys []string) int
+	// Reserve 按照装载因子预先扩容，使字典放入n个键-元素对时不再需要再散列，
+	// 已经足够大时什么也不做。它假设键在散列段之间大致均匀分布，
+	// 散列函数分布不均时个别散列段仍可能再散列
+	Reserve(n uint64)
+	// Compact 收缩键-元素对总数远小于散列桶数量的散列段，以回收内存。
+	// 对于尺寸合理的散列段它什么也不做
+	Compact()
+	// DeletePrefix 删除所有键以prefix开头的键-元素对并返回删除数量，
+	// 每个散列段只加锁一次
+	DeletePrefix(prefix string) int
+	// DeleteWhere 删除所有使pred返回true的未过期键-元素对并返回删除数量，
+	// 每个散列段只加锁一次，pred在锁内被调用，因此不能访问当前字典
+	DeleteWhere(pred func(key string, element interface{}) bool) int
+	// Clear 逐个清空所有散列段。
+	// 并发的读操作可能看到部分被清空的字典
+	Clear()
+	// Len 返回键-元素对的总数，时间复杂度为O(1)
 	Len() uint64
+	// Range 对每个键-元素对调用f，f返回false时停止遍历。
+	// 遍历顺序不确定（设置了WithInsertionOrder时按放入顺序），遍历期间的并发修改可能被观察到也可能不会，
+	// 语义与sync.Map的Range一致
+	Range(f func(key string, element interface{}) bool)
+	// ParallelRange 把散列桶分给workers个goroutine并发地对每个键-元素对调用f，
+	// 因此f必须能被安全地并发调用。workers不大于0时使用runtime.GOMAXPROCS(0)。
+	// 它会等待所有goroutine结束后才返回，任一goroutine中f引发的panic
+	// 会让其余goroutine不再领取新的散列桶，并在调用方的goroutine中重新引发
+	ParallelRange(workers int, f func(key string, element interface{}))
+	// Drain 逐个散列段在持有锁的情况下把每个未过期的键-元素对传给f并删除它，
+	// f返回false时停止，这个键-元素对同样会被删除，尚未传给f的保持不变。
+	// f在锁内被调用，因此不能访问当前字典
+	Drain(f func(key string, element interface{}) bool)
+	// RangeSafe 与Range相同，但f引发的panic会被恢复并以CallbackPanicError的形式返回。
+	// 所有遍历方法都不会在持有锁的情况下调用f，因此panic不会让锁停留在锁定状态
+	RangeSafe(f func(key string, element interface{}) bool) (err error)
+	// RangeContext 与Range相同，但会在遍历每个散列桶之前检查ctx，
+	// ctx结束后不再遍历新的散列桶并返回ctx.Err()
+	RangeContext(ctx context.Context, f func(key string, element interface{}) bool) error
+	// KeysChan 返回一个通道，后台协程会逐个散列桶地遍历字典并把键发送到其中，
+	// 遍历结束或ctx结束后通道会被关闭。不再读取通道的调用方必须结束ctx，
+	// 否则后台协程会一直阻塞在发送上
+	KeysChan(ctx context.Context) <-chan string
+	// RangePrefix 对每个键以prefix开头的键-元素对调用f，f返回false时停止遍历。
+	// 散列破坏了键的局部性，因此它需要扫描全部散列桶，时间复杂度为O(n)
+	RangePrefix(prefix string, f func(key string, element interface{}) bool)
+	// Keys 返回当前所有键的快照
+	Keys() []string
+	// Values 返回当前所有元素的快照
+	Values() []interface{}
+	// String 返回字典的字符串表示形式，其中包含每个非空散列桶的序号和内容。
+	// 未通过WithStringLimit限制时它会输出全部键-元素对，对大字典要谨慎使用
+	String() string
+	// ToMap 返回包含当前所有键-元素对的普通字典快照
+	ToMap() map[string]interface{}
+	// Close 停止后台清理协程，不再使用字典时应调用它
+	Close()
+	// MarshalJSON 把字典序列化为形如{"key": element}的JSON对象，
+	// 元素本身必须可以被JSON编码
+	MarshalJSON() ([]byte, error)
+	// UnmarshalJSON 用JSON对象中的键-元素对替换字典的全部内容，
+	// 它不能与字典的其他操作并发调用
+	UnmarshalJSON(data []byte) error
+	// WriteCSV 基于字典的快照写出表头为key,value的CSV，每个键-元素对占一行，
+	// 元素以fmt.Sprintf("%v")的形式写出，逗号和引号按encoding/csv的规则转义
+	WriteCSV(w io.Writer) error
+	// GobEncode 把字典编码为gob格式，编码时会逐个持有散列段的锁。
+	// 元素的具体类型必须已由调用方通过gob.Register注册
+	GobEncode() ([]byte, error)
+	// GobDecode 用gob数据重建字典的全部内容，
+	// 它不能与字典的其他操作并发调用
+	GobDecode(data []byte) error
+	// Clone 返回字典的深拷贝，拷贝时会逐个持有散列段的锁。
+	// 新字典拥有独立的键-元素对、计数器和默认再分布器
+	Clone() ConcurrentMap
+	// Filter 返回一个只包含pred为true的键-元素对的新字典，
+	// 新字典的配置与当前字典相同，其中的键-元素对都是副本，之后可以独立地修改
+	Filter(pred func(key string, element interface{}) bool) ConcurrentMap
+	// FindKey 扫描全部散列桶，返回第一个元素使pred为true的键，时间复杂度为O(n)。
+	// 遍历顺序不确定，因此有多个匹配时返回哪一个也不确定，需要全部匹配时应使用Filter
+	FindKey(pred func(element interface{}) bool) (key string, found bool)
+	// MapValues 返回一个键与当前字典相同、元素为f返回值的新字典，过期时间保持不变。
+	// 每个散列桶都按某一时刻的内容被遍历，当前字典本身不会被改动
+	MapValues(f func(key string, element interface{}) interface{}) ConcurrentMap
+	// Reduce 在单个协程中依次把每个键-元素对折叠进累加值并返回最终结果，
+	// 累加值从initial开始，因此f无需任何同步
+	Reduce(initial interface{}, f func(acc interface{}, key string, element interface{}) interface{}) interface{}
+	// CountByPrefix 以每个键中第一次出现的sep之前的部分作为前缀，返回前缀到键数量的映射，
+	// 例如sep为":"时键"user:1"计入"user"。不包含sep的键以整个键作为前缀，时间复杂度为O(n)
+	CountByPrefix(sep string) map[string]int
+	// SaveTo 以流的方式把每个键-元素对经encode编码为一条长度前缀的记录写入w，
+	// 返回写入的字节数，encode或w返回的错误会中止写入并被返回
+	SaveTo(w io.Writer, encode func(key string, element interface{}) ([]byte, error)) (int64, error)
+	// LoadFrom 读取SaveTo写出的记录，经decode解码后逐个放入字典，返回读取的字节数。
+	// 不完整或损坏的记录会返回CorruptRecordError，而不会被静默忽略。
+	// SaveTo和LoadFrom的签名与io.WriterTo和io.ReaderFrom不同，因此没有使用WriteTo和ReadFrom这两个名字
+	LoadFrom(r io.Reader, decode func(record []byte) (key string, element interface{}, err error)) (int64, error)
+	// ReadOnly 返回字典的只读视图，它与字典共用同样的数据，并能观察到之后的修改
+	ReadOnly() ReadOnlyMap
+	// Snapshot 返回字典的只读快照，之后的写操作不会影响它。
+	// 它只记录每个散列桶的表头，不会复制键-元素对，因此比Clone廉价得多。
+	Snapshot() Snapshot
+	// Merge 把other中的键-元素对放入当前字典。
+	// 键冲突时以onConflict的返回值作为新元素，onConflict为nil时直接覆盖。
+	// 调用期间other可以被并发读取但不能被修改
+	Merge(other ConcurrentMap, onConflict func(existing, incoming interface{}) interface{})
+	// Equal 判断两个字典是否包含相同的键，并且每个键的元素经eq比较相等，比较基于两个字典各自的快照。
+	// eq为nil时与Diff一样使用==比较，遇到切片等不可比较的元素时改用reflect.DeepEqual，因此不会引发panic
+	Equal(other ConcurrentMap, eq func(a, b interface{}) bool) bool
+	// Diff 基于两个字典各自的快照返回只在当前字典中的键、只在other中的键，
+	// 以及两边都有但元素不相等的键，每个切片都按字典序排列。
+	// 元素的比较方式与eq为nil时的Equal相同
+	Diff(other ConcurrentMap) (onlyLeft, onlyRight, changed []string)
+	// BucketStats 按散列段的顺序返回每个散列桶的当前尺寸
+	BucketStats() []uint64
+	// ChainLengthHistogram 返回链表长度到具有该长度的散列桶数量的映射，
+	// 例如{0: 900, 1: 90, 2: 10}，各散列桶的尺寸以原子操作读取
+	ChainLengthHistogram() map[int]int
+	// BucketIndex 返回键当前所属散列桶在BucketStats结果中的索引，
+	// 它与Put和Get定位散列桶的方式一致，但不会访问散列桶。
+	// 再散列之后同一个键的索引可能改变
+	BucketIndex(key string) int
+	// SampleBucket 返回BucketStats结果中第index个散列桶当前全部未过期键-元素对的副本，
+	// index超出范围时返回nil。随机选择散列桶得到的样本会偏向较短链表中的键，
+	// 需要无偏的估计时可以按BucketStats给出的尺寸加权
+	SampleBucket(index int) []Pair
+	// LoadFactorStdDev 返回所有散列桶尺寸的标准差，可用于发现散列倾斜
+	LoadFactorStdDev() float64
+	// ApproxMemoryBytes 粗略估计字典占用的字节数：每个键-元素对按固定开销加上键的长度计算，
+	// 再加上散列桶的开销。元素本身引用的内存无法在不使用反射的情况下计算，因此不包括在内，
+	// 结果只适合观察趋势
+	ApproxMemoryBytes() uint64
+	// AddIndex 建立名为name的二级索引，它以keyFunc从元素计算出的索引键记录主键，
+	// 建立时会对已有的键-元素对逐一计算，之后随Put、Delete等写操作一起更新。
+	// 覆盖已有的键时keyFunc返回不同的索引键，主键会从旧索引键移到新索引键下。
+	// keyFunc在持有散列段的锁时被调用，因此不能在其中访问字典。
+	// keyFunc为nil或同名索引已存在时返回IllegalParameterError
+	AddIndex(name string, keyFunc func(element interface{}) string) error
+	// QueryIndex 按字典序返回名为name的索引中索引键为indexKey的主键，
+	// 索引不存在时返回nil。已过期但尚未被清理的键也可能出现在结果中
+	QueryIndex(name, indexKey string) []string
+	// CheckInvariants 检查字典内部状态的一致性，发现问题时返回InvariantError：
+	// 各散列桶的尺寸之和与键-元素对总数相等，链表中没有占位符和重复的键，
+	// 并且每个键都位于按它的散列值定位到的散列桶中。
+	// 每个散列段在持有写锁时被检查，但总数在写操作释放锁之后才更新，
+	// 因此它只应在没有并发写操作时调用，主要用于测试
+	CheckInvariants() error
+	// Stats 返回自创建或上次ResetStats以来的累计操作次数
+	Stats() Stats
+	// ResetStats 把累计操作次数清零
+	ResetStats()
 }
 
 type myConcurrentMap struct {
@@ -19,71 +284,1295 @@ type myConcurrentMap struct {
 	concurrency int
 	// 一个散列段
 	segments []Segment
-	total    uint64
+	// 创建散列段时使用的再分布器
+	pairRedistributor PairRedistributor
+	// 创建字典时给定的可选配置
+	opts options
+	// 键-元素对总数，仅在真正新增或删除时更新，
+	// 覆盖已有元素和再散列都不会改变它
+	total uint64
+	// 累计操作次数
+	stats opStats
+	// 用于启动和停止过期键-元素对的后台清理协程
+	sweepOnce sync.Once
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	// 按访问顺序记录键的LRU列表，仅在设置了最大尺寸时存在
+	lru *lruList
+	// 按放入顺序记录键的列表，仅在设置了WithInsertionOrder时存在
+	order *orderList
+	// 按放入顺序淘汰键的列表，仅在设置了WithCapacityFIFO时存在
+	fifo *orderList
+	// 通过AddIndex建立的二级索引
+	indexes *indexSet
+	// GetOrCompute正在进行的计算
+	flights flightGroup
+	// 正在等待键被放入的WaitFor调用
+	waiters *waiterSet
+	// 接收读取耗时的观察者，仅在设置了WithLatencySampling且观察者实现了LatencyObserver时存在
+	latency LatencyObserver
+	// 采样计数器与采样阈值，见sampleLatency
+	latencyTicks     uint64
+	latencyThreshold uint64
 }
 
-func NewConcurrentMap(concurrency int, pairRedistributor PairRedistributor) (ConcurrentMap, error) {
+func NewConcurrentMap(concurrency int, pairRedistributor PairRedistributor, opts ...Option) (ConcurrentMap, error) {
 	if concurrency <= 0 {
-		return nil, newIllegalParameterError("concurrency is too small")
+		return nil, newIllegalParameterErrorWithCause(ErrInvalidConcurrency, "concurrency is too small")
 	}
 	if concurrency > MAX_CONCURRENCY {
-		return nil, newIllegalParameterError("concurrency is too large")
+		return nil, newIllegalParameterErrorWithCause(ErrInvalidConcurrency, "concurrency is too large")
 	}
-	cmap := &myConcurrentMap{}
+	mapOpts := defaultOptions()
+	for _, opt := range opts {
+		if err := opt(&mapOpts); err != nil {
+			return nil, err
+		}
+	}
+	return newMyConcurrentMap(concurrency, pairRedistributor, mapOpts), nil
+}
+
+// newMyConcurrentMap 会按照给定的配置创建一个空的myConcurrentMap类型的实例
+func newMyConcurrentMap(concurrency int, pairRedistributor PairRedistributor, opts options) *myConcurrentMap {
+	cmap := &myConcurrentMap{closeCh: make(chan struct{}), indexes: newIndexSet(), waiters: newWaiterSet()}
 	cmap.concurrency = concurrency
-	cmap.segments = make([]Segment, concurrency)
-	for i := 0; i < concurrency; i++ {
-		cmap.segments[i] = nil //todo 散列桶
+	cmap.pairRedistributor = pairRedistributor
+	cmap.opts = opts
+	if opts.maxSize > 0 {
+		cmap.lru = newLRUList(concurrency, opts.hashFunc)
+	}
+	if opts.insertionOrder {
+		cmap.order = newOrderList(opts.refreshOrderOnPut)
+	}
+	if opts.fifoCapacity > 0 {
+		cmap.fifo = newOrderList(false)
+	}
+	if lo, ok := opts.observer.(LatencyObserver); ok && opts.latencyRate > 0 {
+		cmap.latency = lo
+		cmap.latencyThreshold = math.MaxUint64
+		if opts.latencyRate < 1 {
+			cmap.latencyThreshold = uint64(opts.latencyRate * (1 << 64))
+		}
+	}
+	cmap.segments = cmap.newSegments()
+	return cmap
+}
+
+// newSegments 会按照字典的并发量创建一组空的散列段
+func (cmap *myConcurrentMap) newSegments() []Segment {
+	listeners := pairListeners{cmap.indexes, cmap.waiters}
+	if cmap.lru != nil {
+		listeners = append(listeners, cmap.lru)
 	}
-	return cmap, nil
+	if cmap.order != nil {
+		listeners = append(listeners, cmap.order)
+	}
+	if cmap.fifo != nil {
+		listeners = append(listeners, cmap.fifo)
+	}
+	segments := make([]Segment, cmap.concurrency)
+	for i := 0; i < cmap.concurrency; i++ {
+		segments[i] = newSegment(cmap.opts.bucketNumber, cmap.pairRedistributor, cmap.opts, listeners)
+	}
+	return segments
+}
+
+// reset 会丢弃字典的全部内容，它不能与字典的其他操作并发调用
+func (cmap *myConcurrentMap) reset() {
+	if cmap.lru != nil {
+		cmap.lru = newLRUList(cmap.concurrency, cmap.opts.hashFunc)
+	}
+	if cmap.order != nil {
+		cmap.order = newOrderList(cmap.opts.refreshOrderOnPut)
+	}
+	if cmap.fifo != nil {
+		cmap.fifo = newOrderList(false)
+	}
+	cmap.indexes.reset()
+	cmap.segments = cmap.newSegments()
+	atomic.StoreUint64(&cmap.total, 0)
 }
 
 func (cmap *myConcurrentMap) Concurrency() int {
 	return cmap.concurrency
 }
 
-func (cmap *myConcurrentMap) Put(key string, element interface{}) (bool, error) {
-
-	p, err := newPair(key, element)
+func (cmap *myConcurrentMap) Put(key string, element interface{}) (isNew bool, err error) {
+	p, err := cmap.newPair(key, element)
 	if err != nil {
 		return false, err
 	}
 	s := cmap.findSegment(p.Hash())
 	ok, err := s.Put(p)
 	if ok {
-		atomic.AddUint64(&cmap.total, 1)
+		cmap.addTotal(1)
+	}
+	if err == nil {
+		cmap.putDone(ok)
+	}
+	return ok, err
+}
+
+func (cmap *myConcurrentMap) TryPut(p Pair) (ok bool, inserted bool) {
+	if p == nil {
+		return false, false
+	}
+	np, err := cmap.newPair(p.Key(), p.Element())
+	if err != nil {
+		return false, false
+	}
+	inheritExpiration(np, p)
+	ok, inserted, err = cmap.findSegment(np.Hash()).TryPut(np)
+	if !ok || err != nil {
+		return false, false
+	}
+	cmap.sweepIfExpiring(np)
+	if inserted {
+		cmap.addTotal(1)
+	}
+	cmap.putDone(inserted)
+	return true, inserted
+}
+
+func (cmap *myConcurrentMap) BatchPut(pairs []Pair) (inserted int, err error) {
+	groups := make(map[Segment][]Pair)
+	for i, p := range pairs {
+		if p == nil {
+			return 0, newIllegalParameterErrorWithCause(ErrNilPair, fmt.Sprintf("pair %d is nil", i))
+		}
+		// 按字典自己的散列函数重新创建键-元素对，
+		// 避免调用方持有的键-元素对被链接进散列桶
+		np, err := cmap.newPair(p.Key(), p.Element())
+		if err != nil {
+			return 0, err
+		}
+		inheritExpiration(np, p)
+		cmap.sweepIfExpiring(np)
+		s := cmap.findSegment(np.Hash())
+		groups[s] = append(groups[s], np)
+	}
+	return cmap.putGroups(groups)
+}
+
+func (cmap *myConcurrentMap) PutAll(m map[string]interface{}) error {
+	groups := make(map[Segment][]Pair)
+	var errMsgs []string
+	for key, element := range m {
+		p, err := cmap.newPair(key, element)
+		if err != nil {
+			errMsgs = append(errMsgs, fmt.Sprintf("key %q: %s", key, err))
+			continue
+		}
+		s := cmap.findSegment(p.Hash())
+		groups[s] = append(groups[s], p)
+	}
+	if _, err := cmap.putGroups(groups); err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	}
+	if len(errMsgs) > 0 {
+		sort.Strings(errMsgs)
+		return newIllegalParameterError(strings.Join(errMsgs, "; "))
+	}
+	return nil
+}
+
+// putGroups 把按散列段分组的键-元素对逐组放入，每个散列段只加锁一次
+func (cmap *myConcurrentMap) putGroups(groups map[Segment][]Pair) (inserted int, err error) {
+	for s, group := range groups {
+		n, err := s.PutBatch(group)
+		inserted += n
+		cmap.addTotal(n)
+		if err != nil {
+			// 出错时无法得知覆盖了多少个键-元素对，只记录确定新增的部分
+			cmap.putsDone(n, n)
+			return inserted, err
+		}
+		cmap.putsDone(len(group), n)
+	}
+	return inserted, nil
+}
+
+func (cmap *myConcurrentMap) PutIfAbsent(key string, element interface{}) (bool, error) {
+	p, err := cmap.newPair(key, element)
+	if err != nil {
+		return false, err
+	}
+	s := cmap.findSegment(p.Hash())
+	ok, replaced, err := s.PutIfAbsent(p)
+	if ok && !replaced {
+		cmap.addTotal(1)
+	}
+	if ok {
+		cmap.putDone(true)
 	}
 	return ok, err
 }
 
 func (cmap *myConcurrentMap) Get(key string) interface{} {
+	element, _ := cmap.Load(key)
+	return element
+}
+
+func (cmap *myConcurrentMap) TryGet(key string) (element interface{}, ok bool, acquired bool) {
+	key = cmap.normalize(key)
+	keyHash := cmap.opts.hashFunc(key)
+	s := cmap.findSegment(keyHash)
+	s.BeginRead()
+	pair, acquired := s.TryGetWithHash(key, keyHash)
+	if pair != nil && !isExpired(pair, cmap.now()) {
+		element, ok = cmap.copyValue(pair.Element()), true
+	}
+	s.EndRead()
+	if acquired {
+		cmap.getDone(ok)
+	}
+	return element, ok, acquired
+}
+
+func (cmap *myConcurrentMap) Load(key string) (element interface{}, ok bool) {
+	if cmap.sampleLatency() {
+		start := time.Now()
+		element, ok = cmap.load(key)
+		cmap.latency.OnGetLatency(time.Since(start))
+		return element, ok
+	}
+	return cmap.load(key)
+}
+
+// load 是Load未被采样时的实现
+func (cmap *myConcurrentMap) load(key string) (element interface{}, ok bool) {
+	key = cmap.normalize(key)
+	element, _, ok = cmap.lookup(key)
+	if ok && cmap.lru != nil {
+		cmap.lru.access(key)
+	}
+	return element, ok
+}
+
+func (cmap *myConcurrentMap) GetAll(keys []string) map[string]interface{} {
+	found, _ := cmap.GetAllWithMissing(keys)
+	return found
+}
+
+func (cmap *myConcurrentMap) GetAllWithMissing(keys []string) (found map[string]interface{}, missing []string) {
+	groups := make(map[Segment][]int)
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = cmap.normalize(key)
+		s := cmap.findSegment(cmap.opts.hashFunc(normalized[i]))
+		groups[s] = append(groups[s], i)
+	}
+	hit := make([]bool, len(keys))
+	found = make(map[string]interface{}, len(keys))
+	now := cmap.now()
+	for s, indexes := range groups {
+		group := make([]string, len(indexes))
+		for j, i := range indexes {
+			group[j] = normalized[i]
+		}
+		s.BeginRead()
+		for j, p := range s.GetBatch(group) {
+			if p != nil && !isExpired(p, now) {
+				hit[indexes[j]] = true
+				found[keys[indexes[j]]] = cmap.copyValue(p.Element())
+			}
+		}
+		s.EndRead()
+	}
+	for i, key := range keys {
+		cmap.getDone(hit[i])
+		if !hit[i] {
+			missing = append(missing, key)
+		} else if cmap.lru != nil {
+			cmap.lru.access(normalized[i])
+		}
+	}
+	return found, missing
+}
+
+func (cmap *myConcurrentMap) GetWithVersion(key string) (element interface{}, version uint64, ok bool) {
+	key = cmap.normalize(key)
+	element, version, ok = cmap.lookup(key)
+	if ok && cmap.lru != nil {
+		cmap.lru.access(key)
+	}
+	return element, version, ok
+}
+
+func (cmap *myConcurrentMap) PutIfVersion(key string, element interface{}, expectedVersion uint64) bool {
+	p, err := cmap.newPair(key, element)
+	if err != nil {
+		return false
+	}
+	s := cmap.findSegment(p.Hash())
+	s.Lock()
+	var version uint64
+	if existing := s.GetLocked(p.Key(), p.Hash()); existing != nil && !isExpired(existing, cmap.now()) {
+		version = pairVersion(existing)
+	}
+	if version != expectedVersion {
+		s.Unlock()
+		if cmap.opts.pairPool != nil {
+			releasePair(cmap.opts.pairPool, p)
+		}
+		return false
+	}
+	isNew, err := s.PutLocked(p)
+	s.Unlock()
+	if err != nil {
+		return false
+	}
+	if isNew {
+		cmap.addTotal(1)
+	}
+	cmap.putDone(isNew)
+	return true
+}
+
+func (cmap *myConcurrentMap) Contains(key string) bool {
+	key = cmap.normalize(key)
+	_, _, ok := cmap.lookup(key)
+	return ok
+}
 
-	keyHash := hash(key)
+// lookup 会查找并返回规范化之后的键对应的元素及其版本号，
+// 已过期的键-元素对会被删除并视为不存在
+func (cmap *myConcurrentMap) lookup(key string) (element interface{}, version uint64, ok bool) {
+	keyHash := cmap.opts.hashFunc(key)
 	s := cmap.findSegment(keyHash)
+	s.BeginRead()
 	pair := s.GetWithHash(key, keyHash)
-	if pair == nil {
-		return nil
+	if now := cmap.now(); pair != nil && !isExpired(pair, now) {
+		element, version, ok = cmap.copyValue(pair.Element()), pairVersion(pair), true
+		if cmap.opts.refreshOnGet {
+			refreshExpiration(pair, now)
+		}
+	}
+	s.EndRead()
+	if pair != nil && !ok {
+		cmap.deleteExpired(s, key, keyHash)
+	}
+	cmap.getDone(ok)
+	return element, version, ok
+}
+
+func (cmap *myConcurrentMap) GetOrPut(key string, newElement func() interface{}) (actual interface{}, loaded bool) {
+	key = cmap.normalize(key)
+	keyHash := cmap.opts.hashFunc(key)
+	s := cmap.findSegment(keyHash)
+	s.BeginRead()
+	pair, loaded, replaced, err := s.GetOrPut(key, keyHash, func() interface{} {
+		return cmap.copyValue(newElement())
+	})
+	if err != nil {
+		s.EndRead()
+		return nil, false
+	}
+	actual = cmap.copyValue(pair.Element())
+	s.EndRead()
+	if !loaded && !replaced {
+		cmap.addTotal(1)
+	}
+	cmap.getDone(loaded)
+	if !loaded {
+		cmap.putDone(true)
+	}
+	return actual, loaded
+}
+
+func (cmap *myConcurrentMap) Compute(key string, f func(old interface{}, exists bool) (new interface{}, delete bool)) error {
+	return cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		newElement, del := f(old, exists)
+		if del {
+			return nil, COMPUTE_OP_DELETE
+		}
+		return newElement, COMPUTE_OP_STORE
+	})
+}
+
+func (cmap *myConcurrentMap) Replace(key string, element interface{}) (replaced bool) {
+	cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		if !exists {
+			return nil, COMPUTE_OP_KEEP
+		}
+		replaced = true
+		return element, COMPUTE_OP_STORE
+	})
+	return replaced
+}
+
+func (cmap *myConcurrentMap) CompareAndSwap(key string, old, new interface{}, eq func(a, b interface{}) bool) (swapped bool) {
+	if eq == nil {
+		eq = shallowEqual
+	}
+	cmap.compute(key, func(current interface{}, exists bool) (interface{}, ComputeOp) {
+		if !exists || !eq(current, old) {
+			return nil, COMPUTE_OP_KEEP
+		}
+		swapped = true
+		return new, COMPUTE_OP_STORE
+	})
+	return swapped
+}
+
+func (cmap *myConcurrentMap) Update(keys []string, f func(snapshot map[string]interface{}) map[string]interface{}) error {
+	hashes := make(map[string]uint64, len(keys))
+	var indexes []int
+	locked := make(map[int]bool)
+	for _, key := range keys {
+		keyHash := cmap.opts.hashFunc(cmap.normalize(key))
+		hashes[key] = keyHash
+		if index := cmap.segmentIndex(keyHash); !locked[index] {
+			locked[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		cmap.segments[index].Lock()
+	}
+	inserted, err := cmap.updateLocked(indexes, hashes, f)
+	cmap.addTotal(inserted)
+	return err
+}
+
+// updateLocked 在已经持有indexes中全部散列段写锁的情况下执行Update，
+// 返回前会按相反的顺序释放这些锁，f引发panic时也是如此
+func (cmap *myConcurrentMap) updateLocked(indexes []int, hashes map[string]uint64, f func(snapshot map[string]interface{}) map[string]interface{}) (inserted int, err error) {
+	defer func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			cmap.segments[indexes[i]].Unlock()
+		}
+	}()
+	now := cmap.now()
+	snapshot := make(map[string]interface{}, len(hashes))
+	for key, keyHash := range hashes {
+		if p := cmap.findSegment(keyHash).GetLocked(cmap.normalize(key), keyHash); p != nil && !isExpired(p, now) {
+			snapshot[key] = p.Element()
+		}
+	}
+	for key, element := range f(snapshot) {
+		keyHash, ok := hashes[key]
+		if !ok {
+			continue
+		}
+		var p Pair
+		if p, err = cmap.newPair(key, element); err != nil {
+			break
+		}
+		var isNew bool
+		if isNew, err = cmap.findSegment(keyHash).PutLocked(p); err != nil {
+			break
+		}
+		if isNew {
+			inserted++
+		}
+		cmap.putDone(isNew)
+	}
+	return inserted, err
+}
+
+func (cmap *myConcurrentMap) Rename(oldKey, newKey string, overwrite bool) (bool, error) {
+	normalizedOld, normalizedNew := cmap.normalize(oldKey), cmap.normalize(newKey)
+	oldHash, newHash := cmap.opts.hashFunc(normalizedOld), cmap.opts.hashFunc(normalizedNew)
+	indexes := []int{cmap.segmentIndex(oldHash)}
+	if index := cmap.segmentIndex(newHash); index != indexes[0] {
+		indexes = append(indexes, index)
+		sort.Ints(indexes)
+	}
+	for _, index := range indexes {
+		cmap.segments[index].Lock()
+	}
+	renamed, delta, err := cmap.renameLocked(indexes, normalizedOld, oldHash, newKey, normalizedNew, newHash, overwrite)
+	cmap.addTotal(delta)
+	return renamed, err
+}
+
+// renameLocked 在已经持有indexes中全部散列段写锁的情况下执行Rename，返回前会按相反的顺序释放这些锁。
+// delta为键-元素对总数的变化量：newKey原有的键-元素对被覆盖时为-1，否则为0
+func (cmap *myConcurrentMap) renameLocked(indexes []int, oldKey string, oldHash uint64, rawNewKey, newKey string, newHash uint64, overwrite bool) (renamed bool, delta int, err error) {
+	defer func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			cmap.segments[indexes[i]].Unlock()
+		}
+	}()
+	now := cmap.now()
+	oldSegment, newSegment := cmap.findSegment(oldHash), cmap.findSegment(newHash)
+	p := oldSegment.GetLocked(oldKey, oldHash)
+	if p == nil || isExpired(p, now) {
+		return false, 0, nil
+	}
+	if oldKey == newKey {
+		// 键 - 元素对原地不动，总数也不变
+		return true, 0, nil
+	}
+	if !overwrite {
+		if q := newSegment.GetLocked(newKey, newHash); q != nil && !isExpired(q, now) {
+			return false, 0, nil
+		}
+	}
+	np, err := cmap.newPair(rawNewKey, p.Element())
+	if err != nil {
+		return false, 0, err
+	}
+	inheritExpiration(np, p)
+	isNew, err := newSegment.PutLocked(np)
+	if err != nil {
+		return false, 0, err
+	}
+	cmap.sweepIfExpiring(np)
+	if isNew {
+		delta++
+	}
+	cmap.putDone(isNew)
+	found := oldSegment.DeleteLocked(oldKey, oldHash)
+	if found {
+		delta--
+	}
+	cmap.deleteDone(found)
+	return true, delta, nil
+}
+
+func (cmap *myConcurrentMap) DrainAll() map[string]interface{} {
+	for _, s := range cmap.segments {
+		s.Lock()
+	}
+	var drained [][]Pair
+	for _, s := range cmap.segments {
+		drained = append(drained, s.ResetLocked())
+	}
+	for i := len(cmap.segments) - 1; i >= 0; i-- {
+		cmap.segments[i].Unlock()
+	}
+	m := make(map[string]interface{})
+	var count int
+	now := cmap.now()
+	for _, pairs := range drained {
+		count += len(pairs)
+		for _, p := range pairs {
+			if !isExpired(p, now) {
+				m[displayKey(p)] = p.Element()
+			}
+		}
+	}
+	cmap.addTotal(-count)
+	cmap.deletesDone(count, count)
+	return m
+}
+
+func (cmap *myConcurrentMap) Increment(key string, delta int64) (int64, error) {
+	var value int64
+	var typeErr error
+	err := cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		if !exists {
+			value = delta
+			return value, COMPUTE_OP_STORE
+		}
+		n, ok := old.(int64)
+		if !ok {
+			typeErr = newIllegalParameterErrorWithCause(ErrUnexpectedElementType,
+				fmt.Sprintf("element of key %q is %T, not int64", key, old))
+			return nil, COMPUTE_OP_KEEP
+		}
+		value = n + delta
+		return value, COMPUTE_OP_STORE
+	})
+	if err != nil {
+		return 0, err
+	}
+	if typeErr != nil {
+		return 0, typeErr
+	}
+	return value, nil
+}
+
+func (cmap *myConcurrentMap) Append(key string, values ...interface{}) error {
+	var typeErr error
+	err := cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		var elements []interface{}
+		if exists {
+			var ok bool
+			if elements, ok = old.([]interface{}); !ok {
+				typeErr = newIllegalParameterErrorWithCause(ErrUnexpectedElementType,
+					fmt.Sprintf("element of key %q is %T, not []interface{}", key, old))
+				return nil, COMPUTE_OP_KEEP
+			}
+		}
+		appended := make([]interface{}, len(elements), len(elements)+len(values))
+		copy(appended, elements)
+		return append(appended, values...), COMPUTE_OP_STORE
+	})
+	if err != nil {
+		return err
+	}
+	return typeErr
+}
+
+func (cmap *myConcurrentMap) ComputeWithRetry(key string, maxRetries int, f func(old interface{}, exists bool) interface{}) (interface{}, error) {
+	if maxRetries < 0 {
+		return nil, newIllegalParameterError("max retries is negative")
+	}
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		old, version, exists := cmap.GetWithVersion(key)
+		element := f(old, exists)
+		if cmap.PutIfVersion(key, element, version) {
+			return element, nil
+		}
+	}
+	return nil, newRetriesExhaustedError(key, maxRetries)
+}
+
+func (cmap *myConcurrentMap) Swap(key string, element interface{}) (previous interface{}, loaded bool) {
+	err := cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		previous, loaded = old, exists
+		return element, COMPUTE_OP_STORE
+	})
+	if err != nil {
+		return nil, false
+	}
+	return previous, loaded
+}
+
+func (cmap *myConcurrentMap) LoadAndDelete(key string) (element interface{}, loaded bool) {
+	cmap.compute(key, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		element, loaded = old, exists
+		return nil, COMPUTE_OP_DELETE
+	})
+	return element, loaded
+}
+
+func (cmap *myConcurrentMap) CompareAndDelete(key string, old interface{}, eq func(a, b interface{}) bool) (deleted bool) {
+	if eq == nil {
+		eq = shallowEqual
+	}
+	cmap.compute(key, func(current interface{}, exists bool) (interface{}, ComputeOp) {
+		if !exists || !eq(current, old) {
+			return nil, COMPUTE_OP_KEEP
+		}
+		deleted = true
+		return nil, COMPUTE_OP_DELETE
+	})
+	return deleted
+}
+
+// shallowEqual 使用==比较两个元素
+func shallowEqual(a, b interface{}) bool {
+	return a == b
+}
+
+// safeEqual 使用==比较两个元素，元素不可比较而引发panic时改用reflect.DeepEqual
+func safeEqual(a, b interface{}) (equal bool) {
+	defer func() {
+		if recover() != nil {
+			equal = reflect.DeepEqual(a, b)
+		}
+	}()
+	return a == b
+}
+
+// compute 在散列段的锁内按照f返回的操作更新键对应的键-元素对，并维护总数
+func (cmap *myConcurrentMap) compute(key string, f func(old interface{}, exists bool) (interface{}, ComputeOp)) error {
+	key = cmap.normalize(key)
+	keyHash := cmap.opts.hashFunc(key)
+	if cmap.opts.valueCopier != nil {
+		compute := f
+		f = func(old interface{}, exists bool) (interface{}, ComputeOp) {
+			element, op := compute(old, exists)
+			if op == COMPUTE_OP_STORE {
+				element = cmap.copyValue(element)
+			}
+			return element, op
+		}
+	}
+	var op ComputeOp
+	var existed bool
+	delta, err := cmap.findSegment(keyHash).Compute(key, keyHash, func(old interface{}, exists bool) (interface{}, ComputeOp) {
+		var element interface{}
+		element, op = f(old, exists)
+		existed = exists
+		return element, op
+	})
+	cmap.addTotal(delta)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case COMPUTE_OP_STORE:
+		cmap.putDone(!existed)
+	case COMPUTE_OP_DELETE:
+		cmap.deleteDone(existed)
 	}
-	return pair.Element()
+	return nil
 }
 
 func (cmap *myConcurrentMap) Delete(key string) bool {
+	found := cmap.delete(key)
+	cmap.deleteDone(found)
+	return found
+}
 
-	s := cmap.findSegment(hash(key))
-	if s.Delete(key) {
+// delete 删除键对应的键-元素对，但不会通知观察者
+func (cmap *myConcurrentMap) delete(key string) bool {
+	key = cmap.normalize(key)
+	keyHash := cmap.opts.hashFunc(key)
+	s := cmap.findSegment(keyHash)
+	if s.DeleteWithHash(key, keyHash) {
 		atomic.AddUint64(&cmap.total, ^uint64(0))
 		return true
 	}
 	return false
 }
+
+func (cmap *myConcurrentMap) BatchDelete(keys []string) int {
+	groups := make(map[Segment][]string)
+	for _, key := range keys {
+		key = cmap.normalize(key)
+		s := cmap.findSegment(cmap.opts.hashFunc(key))
+		groups[s] = append(groups[s], key)
+	}
+	var deleted int
+	for s, group := range groups {
+		n := s.DeleteBatch(group)
+		if n > 0 {
+			atomic.AddUint64(&cmap.total, ^uint64(n-1))
+		}
+		cmap.deletesDone(len(group), n)
+		deleted += n
+	}
+	return deleted
+}
+
+func (cmap *myConcurrentMap) DeletePrefix(prefix string) int {
+	return cmap.deleteMatching(func(p Pair) bool {
+		return strings.HasPrefix(p.Key(), prefix)
+	})
+}
+
+func (cmap *myConcurrentMap) DeleteWhere(pred func(key string, element interface{}) bool) int {
+	now := cmap.now()
+	return cmap.deleteMatching(func(p Pair) bool {
+		return !isExpired(p, now) && pred(displayKey(p), p.Element())
+	})
+}
+
+// deleteMatching 删除所有使pred返回true的键-元素对并返回删除数量
+func (cmap *myConcurrentMap) deleteMatching(pred func(p Pair) bool) int {
+	var deleted int
+	for _, s := range cmap.segments {
+		n := s.DeleteMatching(pred)
+		cmap.addTotal(-n)
+		cmap.deletesDone(n, n)
+		deleted += n
+	}
+	return deleted
+}
+
+func (cmap *myConcurrentMap) Reserve(n uint64) {
+	// findSegment以concurrency-1取模，并发量大于1时最后一个散列段不会被用到
+	used := uint64(cmap.concurrency)
+	if used > 1 {
+		used--
+	}
+	// 再留出八分之一的余量以容纳散列段之间的不均
+	perSegment := (n + used - 1) / used
+	perSegment += perSegment / 8
+	for _, s := range cmap.segments {
+		s.Reserve(perSegment)
+	}
+}
+
+func (cmap *myConcurrentMap) Compact() {
+	for _, s := range cmap.segments {
+		s.Compact()
+	}
+}
+
+func (cmap *myConcurrentMap) Clear() {
+	for _, s := range cmap.segments {
+		// 只减去被清除的数量，以免丢失其他散列段中并发新增的计数
+		if count := s.Clear(); count > 0 {
+			atomic.AddUint64(&cmap.total, ^(count - 1))
+			cmap.deletesDone(int(count), int(count))
+		}
+	}
+}
+
 func (cmap *myConcurrentMap) Len() uint64 {
 	return atomic.LoadUint64(&cmap.total)
 }
 
+func (cmap *myConcurrentMap) Range(f func(key string, element interface{}) bool) {
+	if cmap.order != nil {
+		cmap.rangeInOrder(f)
+		return
+	}
+	now := cmap.now()
+	for _, s := range cmap.segments {
+		if !s.Range(func(p Pair) bool {
+			if isExpired(p, now) {
+				return true
+			}
+			return f(displayKey(p), p.Element())
+		}) {
+			return
+		}
+	}
+}
+
+func (cmap *myConcurrentMap) RangeSafe(f func(key string, element interface{}) bool) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = newCallbackPanicError(p)
+		}
+	}()
+	cmap.Range(f)
+	return nil
+}
+
+func (cmap *myConcurrentMap) ParallelRange(workers int, f func(key string, element interface{})) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var buckets []Bucket
+	for _, s := range cmap.segments {
+		s.BeginRead()
+		defer s.EndRead()
+		buckets = append(buckets, s.Buckets()...)
+	}
+	now := cmap.now()
+	var next int64 = -1
+	var panicked int32
+	var panicValue interface{}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if p := recover(); p != nil {
+					if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+						panicValue = p
+					}
+				}
+			}()
+			for atomic.LoadInt32(&panicked) == 0 {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(buckets)) {
+					return
+				}
+				for _, p := range buckets[i].Pairs() {
+					if !isExpired(p, now) {
+						f(displayKey(p), p.Element())
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if panicValue != nil {
+		panic(panicValue)
+	}
+}
+
+func (cmap *myConcurrentMap) Drain(f func(key string, element interface{}) bool) {
+	for _, s := range cmap.segments {
+		drained, stopped := s.Drain(f)
+		cmap.addTotal(-drained)
+		cmap.deletesDone(drained, drained)
+		if stopped {
+			return
+		}
+	}
+}
+
+func (cmap *myConcurrentMap) RangeContext(ctx context.Context, f func(key string, element interface{}) bool) error {
+	now := cmap.now()
+	for _, s := range cmap.segments {
+		if more, err := rangeSegmentContext(ctx, s, now, f); !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeSegmentContext 对散列段s执行RangeContext的遍历，返回是否应继续遍历下一个散列段。
+// 读操作的计数在f引发panic时也会被恢复
+func rangeSegmentContext(ctx context.Context, s Segment, now int64, f func(key string, element interface{}) bool) (bool, error) {
+	s.BeginRead()
+	defer s.EndRead()
+	for _, b := range s.Buckets() {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		for _, p := range b.Pairs() {
+			if isExpired(p, now) {
+				continue
+			}
+			if !f(displayKey(p), p.Element()) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func (cmap *myConcurrentMap) KeysChan(ctx context.Context) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		cmap.RangeContext(ctx, func(key string, element interface{}) bool {
+			select {
+			case keys <- key:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return keys
+}
+
+func (cmap *myConcurrentMap) RangePrefix(prefix string, f func(key string, element interface{}) bool) {
+	cmap.Range(func(key string, element interface{}) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		return f(key, element)
+	})
+}
+
+func (cmap *myConcurrentMap) Keys() []string {
+	keys := make([]string, 0, cmap.Len())
+	cmap.Range(func(key string, element interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func (cmap *myConcurrentMap) Values() []interface{} {
+	values := make([]interface{}, 0, cmap.Len())
+	cmap.Range(func(key string, element interface{}) bool {
+		values = append(values, element)
+		return true
+	})
+	return values
+}
+
+func (cmap *myConcurrentMap) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("cmap{")
+	var index, count int
+	for _, s := range cmap.segments {
+		s.BeginRead()
+		for _, b := range s.Buckets() {
+			size := int(b.Size())
+			if size > 0 {
+				if limit := cmap.opts.stringLimit; limit > 0 && count >= limit {
+					s.EndRead()
+					buf.WriteString(fmt.Sprintf(" ...(%d pairs omitted)", int(cmap.Len())-count))
+					buf.WriteString("}")
+					return buf.String()
+				}
+				buf.WriteString(fmt.Sprintf(" %d:%s", index, b.String()))
+				count += size
+			}
+			index++
+		}
+		s.EndRead()
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (cmap *myConcurrentMap) ToMap() map[string]interface{} {
+	m := make(map[string]interface{}, cmap.Len())
+	cmap.Range(func(key string, element interface{}) bool {
+		m[key] = element
+		return true
+	})
+	return m
+}
+
+func (cmap *myConcurrentMap) Clone() ConcurrentMap {
+	clone := newMyConcurrentMap(cmap.concurrency, nil, cmap.opts)
+	now := cmap.now()
+	for _, s := range cmap.segments {
+		for _, p := range s.CopyPairs() {
+			if isExpired(p, now) {
+				continue
+			}
+			if ok, _ := clone.findSegment(p.Hash()).Put(p); ok {
+				clone.addTotal(1)
+			}
+			clone.sweepIfExpiring(p)
+		}
+	}
+	return clone
+}
+
+func (cmap *myConcurrentMap) Filter(pred func(key string, element interface{}) bool) ConcurrentMap {
+	var selected []Pair
+	now := cmap.now()
+	for _, s := range cmap.segments {
+		s.Range(func(p Pair) bool {
+			if !isExpired(p, now) && pred(displayKey(p), p.Element()) {
+				selected = append(selected, p.Copy())
+			}
+			return true
+		})
+	}
+	return cmap.derive(selected)
+}
+
+func (cmap *myConcurrentMap) FindKey(pred func(element interface{}) bool) (key string, found bool) {
+	cmap.Range(func(k string, element interface{}) bool {
+		if pred(element) {
+			key, found = k, true
+			return false
+		}
+		return true
+	})
+	return key, found
+}
+
+func (cmap *myConcurrentMap) MapValues(f func(key string, element interface{}) interface{}) ConcurrentMap {
+	pairs := make([]Pair, 0, cmap.Len())
+	now := cmap.now()
+	for _, s := range cmap.segments {
+		s.Range(func(p Pair) bool {
+			if isExpired(p, now) {
+				return true
+			}
+			np, err := newPairWithHash(p.Key(), p.Hash(), f(displayKey(p), p.Element()))
+			if err != nil {
+				return true
+			}
+			inheritExpiration(np, p)
+			inheritRawKey(np, p)
+			pairs = append(pairs, np)
+			return true
+		})
+	}
+	return cmap.derive(pairs)
+}
+
+func (cmap *myConcurrentMap) Reduce(initial interface{}, f func(acc interface{}, key string, element interface{}) interface{}) interface{} {
+	acc := initial
+	cmap.Range(func(key string, element interface{}) bool {
+		acc = f(acc, key, element)
+		return true
+	})
+	return acc
+}
+
+func (cmap *myConcurrentMap) CountByPrefix(sep string) map[string]int {
+	counts := make(map[string]int)
+	cmap.Range(func(key string, element interface{}) bool {
+		prefix, _, _ := strings.Cut(key, sep)
+		counts[prefix]++
+		return true
+	})
+	return counts
+}
+
+// derive 会创建一个配置与当前字典相同的新字典，按pairs的数量预留散列桶后放入它们
+func (cmap *myConcurrentMap) derive(pairs []Pair) *myConcurrentMap {
+	derived := newMyConcurrentMap(cmap.concurrency, nil, cmap.opts)
+	derived.Reserve(uint64(len(pairs)))
+	for _, p := range pairs {
+		if ok, _ := derived.findSegment(p.Hash()).Put(p); ok {
+			derived.addTotal(1)
+		}
+		derived.sweepIfExpiring(p)
+	}
+	return derived
+}
+
+func (cmap *myConcurrentMap) Merge(other ConcurrentMap, onConflict func(existing, incoming interface{}) interface{}) {
+	other.Range(func(key string, element interface{}) bool {
+		if onConflict == nil {
+			cmap.Put(key, element)
+			return true
+		}
+		p, err := cmap.newPair(key, element)
+		if err != nil {
+			return true
+		}
+		ok, err := cmap.findSegment(p.Hash()).Upsert(p, onConflict)
+		if ok {
+			cmap.addTotal(1)
+		}
+		if err == nil {
+			cmap.putDone(ok)
+		}
+		return true
+	})
+}
+
+func (cmap *myConcurrentMap) Equal(other ConcurrentMap, eq func(a, b interface{}) bool) bool {
+	if eq == nil {
+		eq = safeEqual
+	}
+	left, right := cmap.Snapshot(), other.Snapshot()
+	if left.Len() != right.Len() {
+		return false
+	}
+	equal := true
+	left.Range(func(key string, element interface{}) bool {
+		incoming, ok := right.Load(key)
+		equal = ok && eq(element, incoming)
+		return equal
+	})
+	return equal
+}
+
+func (cmap *myConcurrentMap) Diff(other ConcurrentMap) (onlyLeft, onlyRight, changed []string) {
+	left, right := cmap.Snapshot(), other.Snapshot()
+	left.Range(func(key string, element interface{}) bool {
+		if incoming, ok := right.Load(key); !ok {
+			onlyLeft = append(onlyLeft, key)
+		} else if !safeEqual(element, incoming) {
+			changed = append(changed, key)
+		}
+		return true
+	})
+	right.Range(func(key string, element interface{}) bool {
+		if _, ok := left.Load(key); !ok {
+			onlyRight = append(onlyRight, key)
+		}
+		return true
+	})
+	sort.Strings(onlyLeft)
+	sort.Strings(onlyRight)
+	sort.Strings(changed)
+	return onlyLeft, onlyRight, changed
+}
+
+func (cmap *myConcurrentMap) BucketStats() []uint64 {
+	var stats []uint64
+	for _, s := range cmap.segments {
+		stats = append(stats, s.BucketSizes()...)
+	}
+	return stats
+}
+
+func (cmap *myConcurrentMap) ChainLengthHistogram() map[int]int {
+	histogram := make(map[int]int)
+	for _, size := range cmap.BucketStats() {
+		histogram[int(size)]++
+	}
+	return histogram
+}
+
+func (cmap *myConcurrentMap) BucketIndex(key string) int {
+	keyHash := cmap.opts.hashFunc(cmap.normalize(key))
+	target := cmap.segmentIndex(keyHash)
+	var offset int
+	for _, s := range cmap.segments[:target] {
+		offset += len(s.Buckets())
+	}
+	return offset + cmap.segments[target].BucketIndex(keyHash)
+}
+
+func (cmap *myConcurrentMap) SampleBucket(index int) []Pair {
+	if index < 0 {
+		return nil
+	}
+	for _, s := range cmap.segments {
+		s.BeginRead()
+		buckets := s.Buckets()
+		if index >= len(buckets) {
+			s.EndRead()
+			index -= len(buckets)
+			continue
+		}
+		now := cmap.now()
+		var pairs []Pair
+		for _, p := range buckets[index].Pairs() {
+			if !isExpired(p, now) {
+				pairs = append(pairs, p.Copy())
+			}
+		}
+		s.EndRead()
+		return pairs
+	}
+	return nil
+}
+
+func (cmap *myConcurrentMap) LoadFactorStdDev() float64 {
+	stats := cmap.BucketStats()
+	if len(stats) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, size := range stats {
+		sum += float64(size)
+	}
+	mean := sum / float64(len(stats))
+	var variance float64
+	for _, size := range stats {
+		variance += (float64(size) - mean) * (float64(size) - mean)
+	}
+	return math.Sqrt(variance / float64(len(stats)))
+}
+
+// addTotal 会把键-元素对总数增加delta，delta可以为负数
+func (cmap *myConcurrentMap) addTotal(delta int) {
+	if delta != 0 {
+		atomic.AddUint64(&cmap.total, uint64(int64(delta)))
+	}
+	if delta > 0 && cmap.lru != nil {
+		cmap.evict()
+	}
+	if delta > 0 && cmap.fifo != nil {
+		cmap.evictFIFO()
+	}
+}
+
+// newPair 会使用字典的散列函数创建一个Pair类型的实例，
+// 键会被规范化，原始键被记录在键 - 元素对中，元素会被复制
+func (cmap *myConcurrentMap) newPair(key string, element interface{}) (Pair, error) {
+	element = cmap.copyValue(element)
+	normalized := cmap.normalize(key)
+	var p Pair
+	var err error
+	if cmap.opts.pairPool != nil {
+		p, err = acquirePair(cmap.opts.pairPool, normalized, cmap.opts.hashFunc(normalized), element)
+	} else {
+		p, err = newPairWithHash(normalized, cmap.opts.hashFunc(normalized), element)
+	}
+	if err == nil && normalized != key {
+		p.(*pair).rawKey = key
+	}
+	return p, err
+}
+
+// copyValue 返回元素的防御性副本，没有指定复制函数时返回element本身
+func (cmap *myConcurrentMap) copyValue(element interface{}) interface{} {
+	if cmap.opts.valueCopier == nil {
+		return element
+	}
+	return cmap.opts.valueCopier(element)
+}
+
+// normalize 返回用于散列和比较的键，没有指定规范化函数时返回key本身
+func (cmap *myConcurrentMap) normalize(key string) string {
+	if cmap.opts.keyNormalizer == nil {
+		return key
+	}
+	return cmap.opts.keyNormalizer(key)
+}
+
 // 给定参数寻找并返回对应散列段
 func (cmap *myConcurrentMap) findSegment(keyHash uint64) Segment {
+	return cmap.segments[cmap.segmentIndex(keyHash)]
+}
+
+// 给定参数计算对应散列段的索引
+func (cmap *myConcurrentMap) segmentIndex(keyHash uint64) int {
 	if cmap.concurrency == 1 {
-		return cmap.segments[0]
+		return 0
 	}
 	var keyHash32 uint32
 	if keyHash > math.MaxUint32 {
@@ -91,5 +1580,5 @@ func (cmap *myConcurrentMap) findSegment(keyHash uint64) Segment {
 	} else {
 		keyHash32 = uint32(keyHash)
 	}
-	return cmap.segments[int(keyHash32>>16)%(cmap.concurrency-1)]
+	return int(keyHash32>>16) % (cmap.concurrency - 1)
 }
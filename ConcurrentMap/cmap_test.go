@@ -1,7 +1,3257 @@
 package concurrentMap
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func Test_CMap(t *testing.T) {
 	t.Log(^uint64(0))
 }
+
+func Test_CMapPutIfAbsent(t *testing.T) {
+	cmap, err := NewConcurrentMap(16, nil)
+	if err != nil {
+		t.Fatalf("new concurrent map: %s", err)
+	}
+	ok, err := cmap.PutIfAbsent("a", 1)
+	if err != nil || !ok {
+		t.Fatalf("first PutIfAbsent: ok=%v, err=%v", ok, err)
+	}
+	ok, err = cmap.PutIfAbsent("a", 2)
+	if err != nil || ok {
+		t.Fatalf("second PutIfAbsent: ok=%v, err=%v", ok, err)
+	}
+	if e := cmap.Get("a"); e != 1 {
+		t.Fatalf("element of a: expected 1, got %v", e)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapRange(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	seen := make(map[string]bool)
+	cmap.Range(func(key string, element interface{}) bool {
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 100 {
+		t.Fatalf("range: expected 100 keys, got %d", len(seen))
+	}
+	var count int
+	cmap.Range(func(key string, element interface{}) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("range stop: expected 10 calls, got %d", count)
+	}
+}
+
+func Test_CMapKeysAndValues(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	number := 1000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	keys := cmap.Keys()
+	if len(keys) != number {
+		t.Fatalf("keys: expected %d, got %d", number, len(keys))
+	}
+	for _, key := range keys {
+		if cmap.Get(key) == nil {
+			t.Fatalf("key %q does not round-trip", key)
+		}
+	}
+	if values := cmap.Values(); len(values) != number {
+		t.Fatalf("values: expected %d, got %d", number, len(values))
+	}
+}
+
+func Test_CMapGetOrPut(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	var calls int
+	newElement := func() interface{} {
+		calls++
+		return calls
+	}
+	actual, loaded := cmap.GetOrPut("a", newElement)
+	if loaded || actual != 1 {
+		t.Fatalf("first GetOrPut: actual=%v, loaded=%v", actual, loaded)
+	}
+	actual, loaded = cmap.GetOrPut("a", newElement)
+	if !loaded || actual != 1 {
+		t.Fatalf("second GetOrPut: actual=%v, loaded=%v", actual, loaded)
+	}
+	if calls != 1 {
+		t.Fatalf("newElement calls: expected 1, got %d", calls)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapLen(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	number := 5000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), -i)
+		cmap.PutIfAbsent(fmt.Sprintf("k%d", i), i)
+	}
+	if l := cmap.Len(); l != uint64(number) {
+		t.Fatalf("len after overwrites: expected %d, got %d", number, l)
+	}
+	cmap.Delete("k0")
+	cmap.Delete("k0")
+	cmap.Delete("missing")
+	if l := cmap.Len(); l != uint64(number-1) {
+		t.Fatalf("len after deletes: expected %d, got %d", number-1, l)
+	}
+}
+
+func Test_TypedMap(t *testing.T) {
+	tm, err := NewTypedMap[int](16, nil)
+	if err != nil {
+		t.Fatalf("new typed map: %s", err)
+	}
+	if err := tm.Put("a", 1); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if v, ok := tm.Get("a"); !ok || v != 1 {
+		t.Fatalf("get a: v=%d, ok=%v", v, ok)
+	}
+	if v, ok := tm.Get("missing"); ok || v != 0 {
+		t.Fatalf("get missing: v=%d, ok=%v", v, ok)
+	}
+	// 绕过类型检查放入不匹配的元素
+	tm.cmap.Put("b", "not an int")
+	if v, ok := tm.Get("b"); ok || v != 0 {
+		t.Fatalf("get mismatched b: v=%d, ok=%v", v, ok)
+	}
+	if !tm.Delete("a") {
+		t.Fatalf("delete a: expected true")
+	}
+	etm, _ := NewTypedMap[error](1, nil)
+	if err := etm.Put("nil", nil); err != nil {
+		t.Fatalf("put nil interface element: %s", err)
+	}
+	if v, ok := etm.Get("nil"); !ok || v != nil {
+		t.Fatalf("get nil interface element: v=%v, ok=%v", v, ok)
+	}
+}
+
+// fakeClock 代表测试中手动推进的时钟，使过期相关的测试不依赖真实的时间流逝
+type fakeClock struct {
+	nanos int64
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{nanos: time.Now().UnixNano()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.nanos))
+}
+
+// Advance 把时钟向前推进d
+func (c *fakeClock) Advance(d time.Duration) {
+	atomic.AddInt64(&c.nanos, int64(d))
+}
+
+func Test_CMapWithClock(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithClock(nil)); err == nil {
+		t.Fatalf("nil clock: expected error")
+	}
+}
+
+func Test_CMapTTL(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithClock(clock.Now))
+	defer cmap.Close()
+	if _, err := cmap.PutWithTTL("a", 1, 0); err == nil {
+		t.Fatalf("put with zero ttl: expected error")
+	}
+	cmap.PutWithTTL("a", 1, 20*time.Millisecond)
+	cmap.PutWithTTL("b", 2, time.Hour)
+	cmap.Put("c", 3)
+	if e := cmap.Get("a"); e != 1 {
+		t.Fatalf("element of a before expiry: expected 1, got %v", e)
+	}
+	clock.Advance(30 * time.Millisecond)
+	if e := cmap.Get("a"); e != nil {
+		t.Fatalf("element of a after expiry: expected nil, got %v", e)
+	}
+	if l := cmap.Len(); l != 2 {
+		t.Fatalf("len after lazy deletion: expected 2, got %d", l)
+	}
+	cmap.PutWithTTL("d", 4, time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	cmap.(*myConcurrentMap).deleteAllExpired(clock.Now().UnixNano())
+	if l := cmap.Len(); l != 2 {
+		t.Fatalf("len after sweeping: expected 2, got %d", l)
+	}
+}
+
+func Test_CMapSweepStartsForCopiedExpiringPairs(t *testing.T) {
+	// sweeping 判断后台清理协程是否已经启动：已启动时sweepOnce不会再执行给定的函数
+	sweeping := func(m ConcurrentMap) bool {
+		started := true
+		m.(*myConcurrentMap).sweepOnce.Do(func() { started = false })
+		return started
+	}
+	plain, _ := NewConcurrentMap(4, nil)
+	plain.Put("a", 1)
+	if sweeping(plain.Clone()) {
+		t.Fatalf("clone without expiring pairs: expected no sweeper")
+	}
+	source, _ := NewConcurrentMap(4, nil)
+	defer source.Close()
+	source.PutWithTTL("a", 1, time.Hour)
+	data, _ := source.(*myConcurrentMap).GobEncode()
+	decoded, _ := NewConcurrentMap(4, nil)
+	decoded.(*myConcurrentMap).GobDecode(data)
+	p, _ := newPair("b", 2)
+	p.SetExpiration(time.Now().Add(time.Hour).UnixNano())
+	tried, _ := NewConcurrentMap(4, nil)
+	tried.TryPut(p)
+	batched, _ := NewConcurrentMap(4, nil)
+	batched.BatchPut([]Pair{p})
+	derived := map[string]ConcurrentMap{
+		"clone":      source.Clone(),
+		"filter":     source.Filter(func(string, interface{}) bool { return true }),
+		"map values": source.MapValues(func(_ string, element interface{}) interface{} { return element }),
+		"gob decode": decoded,
+		"try put":    tried,
+		"batch put":  batched,
+	}
+	for name, m := range derived {
+		if !sweeping(m) {
+			t.Fatalf("%s with expiring pairs: expected the sweeper to be started", name)
+		}
+		m.Close()
+	}
+}
+
+func Test_CMapJSON(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", "x")
+	cmap.Put("b", 2.5)
+	data, err := json.Marshal(cmap)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	if string(data) != `{"a":"x","b":2.5}` {
+		t.Fatalf("marshal: unexpected output %s", data)
+	}
+	other, _ := NewConcurrentMap(4, nil)
+	other.Put("stale", true)
+	if err := json.Unmarshal(data, other); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if l := other.Len(); l != 2 {
+		t.Fatalf("len after unmarshal: expected 2, got %d", l)
+	}
+	if other.Get("a") != "x" || other.Get("b") != 2.5 || other.Get("stale") != nil {
+		t.Fatalf("unmarshal: unexpected elements %v", other.Keys())
+	}
+}
+
+func Test_CMapClone(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	clone := cmap.Clone()
+	if l := clone.Len(); l != 100 {
+		t.Fatalf("len of clone: expected 100, got %d", l)
+	}
+	clone.Put("k0", -1)
+	clone.Delete("k1")
+	cmap.Put("k100", 100)
+	if e := cmap.Get("k0"); e != 0 {
+		t.Fatalf("element of k0 in source: expected 0, got %v", e)
+	}
+	if cmap.Get("k1") == nil || clone.Get("k100") != nil {
+		t.Fatalf("clone is not independent of source")
+	}
+	if cmap.Len() != 101 || clone.Len() != 99 {
+		t.Fatalf("len: source %d, clone %d", cmap.Len(), clone.Len())
+	}
+}
+
+func Test_CMapMerge(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	cmap.Put("b", 2)
+	other, _ := NewConcurrentMap(8, nil)
+	other.Put("b", 20)
+	other.Put("c", 30)
+	cmap.Merge(other, func(existing, incoming interface{}) interface{} {
+		return existing.(int) + incoming.(int)
+	})
+	if e := cmap.Get("b"); e != 22 {
+		t.Fatalf("element of b: expected 22, got %v", e)
+	}
+	if e := cmap.Get("c"); e != 30 {
+		t.Fatalf("element of c: expected 30, got %v", e)
+	}
+	if l := cmap.Len(); l != 3 {
+		t.Fatalf("len: expected 3, got %d", l)
+	}
+	cmap.Merge(other, nil)
+	if e := cmap.Get("b"); e != 20 {
+		t.Fatalf("element of b after overwrite: expected 20, got %v", e)
+	}
+}
+
+func Test_CMapWithHashFunc(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithHashFunc(nil)); err == nil {
+		t.Fatalf("nil hash function: expected error")
+	}
+	var calls int64
+	fnv1a := func(key string) uint64 {
+		atomic.AddInt64(&calls, 1)
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	cmap, err := NewConcurrentMap(16, nil, WithHashFunc(fnv1a))
+	if err != nil {
+		t.Fatalf("new concurrent map: %s", err)
+	}
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if e := cmap.Get(fmt.Sprintf("k%d", i)); e != i {
+			t.Fatalf("element of k%d: expected %d, got %v", i, i, e)
+		}
+	}
+	if !cmap.Delete("k0") || cmap.Get("k0") != nil {
+		t.Fatalf("delete with custom hash function failed")
+	}
+	if atomic.LoadInt64(&calls) == 0 {
+		t.Fatalf("custom hash function was never called")
+	}
+}
+
+func Test_CMapBucketStats(t *testing.T) {
+	cmap, _ := NewConcurrentMap(2, nil, WithHashFunc(func(key string) uint64 {
+		return 0
+	}))
+	for i := 0; i < 10; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	stats := cmap.BucketStats()
+	if len(stats) != 2*DEFAULT_BUCKET_NUMBER {
+		t.Fatalf("bucket stats: expected %d buckets, got %d", 2*DEFAULT_BUCKET_NUMBER, len(stats))
+	}
+	var sum uint64
+	for _, size := range stats {
+		sum += size
+	}
+	if sum != 10 || stats[0] != 10 {
+		t.Fatalf("bucket stats: unexpected sizes %v", stats)
+	}
+	if cmap.LoadFactorStdDev() == 0 {
+		t.Fatalf("skewed distribution: expected non-zero standard deviation")
+	}
+}
+
+func Test_CMapGrowth(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithLoadFactor(0)); err == nil {
+		t.Fatalf("zero load factor: expected error")
+	}
+	cmap, _ := NewConcurrentMap(16, nil)
+	initialBuckets := len(cmap.BucketStats())
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("fixed%d", i), i)
+	}
+	done := make(chan struct{})
+	missed := make(chan string, 1)
+	go func() {
+		defer close(done)
+		for round := 0; round < 50; round++ {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("fixed%d", i)
+				if cmap.Get(key) == nil {
+					missed <- key
+					return
+				}
+			}
+		}
+	}()
+	number := 100000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	<-done
+	select {
+	case key := <-missed:
+		t.Fatalf("key %q was not found during resizing", key)
+	default:
+	}
+	if buckets := len(cmap.BucketStats()); buckets <= initialBuckets {
+		t.Fatalf("bucket count did not grow: %d", buckets)
+	}
+	for i := 0; i < number; i++ {
+		if e := cmap.Get(fmt.Sprintf("k%d", i)); e != i {
+			t.Fatalf("element of k%d: expected %d, got %v", i, i, e)
+		}
+	}
+	if l := cmap.Len(); l != uint64(number+100) {
+		t.Fatalf("len: expected %d, got %d", number+100, l)
+	}
+}
+
+func Test_CMapBatchPut(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("k0", -1)
+	var pairs []Pair
+	for i := 0; i < 1000; i++ {
+		p, _ := newPair(fmt.Sprintf("k%d", i), i)
+		pairs = append(pairs, p)
+	}
+	inserted, err := cmap.BatchPut(pairs)
+	if err != nil {
+		t.Fatalf("batch put: %s", err)
+	}
+	if inserted != 999 {
+		t.Fatalf("inserted: expected 999, got %d", inserted)
+	}
+	if l := cmap.Len(); l != 1000 {
+		t.Fatalf("len: expected 1000, got %d", l)
+	}
+	if e := cmap.Get("k0"); e != 0 {
+		t.Fatalf("element of k0: expected 0, got %v", e)
+	}
+	if _, err := cmap.BatchPut([]Pair{pairs[0], nil}); err == nil {
+		t.Fatalf("batch put with nil pair: expected error")
+	}
+}
+
+func Test_CMapBatchDelete(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i)
+		cmap.Put(key, i)
+		if i%2 == 0 {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, "missing", keys[0])
+	if deleted := cmap.BatchDelete(keys); deleted != 500 {
+		t.Fatalf("deleted: expected 500, got %d", deleted)
+	}
+	if l := cmap.Len(); l != 500 {
+		t.Fatalf("len: expected 500, got %d", l)
+	}
+	if cmap.Get("k0") != nil || cmap.Get("k1") == nil {
+		t.Fatalf("batch delete removed the wrong keys")
+	}
+}
+
+func Test_CMapRangeContext(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	var count int
+	err := cmap.RangeContext(context.Background(), func(key string, element interface{}) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 1000 {
+		t.Fatalf("range context: count=%d, err=%v", count, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	count = 0
+	err = cmap.RangeContext(ctx, func(key string, element interface{}) bool {
+		count++
+		cancel()
+		return true
+	})
+	if err != context.Canceled {
+		t.Fatalf("cancelled range context: expected context.Canceled, got %v", err)
+	}
+	if count == 0 || count == 1000 {
+		t.Fatalf("cancelled range context: unexpected count %d", count)
+	}
+	if l := cmap.Len(); l != 1000 {
+		t.Fatalf("len after cancellation: expected 1000, got %d", l)
+	}
+}
+
+func Test_PairCopyKeepsHash(t *testing.T) {
+	p, _ := newPairWithHash("a", 42, 1)
+	p.SetExpiration(7)
+	pCopy := p.Copy()
+	if pCopy.Hash() != 42 || pCopy.Expiration() != 7 {
+		t.Fatalf("copy: hash=%d, expiration=%d", pCopy.Hash(), pCopy.Expiration())
+	}
+	var calls int64
+	cmap, _ := NewConcurrentMap(1, nil, WithHashFunc(func(key string) uint64 {
+		atomic.AddInt64(&calls, 1)
+		return hash(key)
+	}))
+	number := 1000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	// 再散列不应重新计算散列值
+	if c := atomic.LoadInt64(&calls); c != int64(number) {
+		t.Fatalf("hash function calls: expected %d, got %d", number, c)
+	}
+}
+
+func Test_CMapWithRWLock(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil, WithRWLock())
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if e := cmap.Get(fmt.Sprintf("k%d", i)); e != i {
+			t.Fatalf("element of k%d: expected %d, got %v", i, i, e)
+		}
+	}
+}
+
+func benchmarkCMapGetParallel(b *testing.B, opts ...Option) {
+	cmap, _ := NewConcurrentMap(16, nil, opts...)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+		cmap.Put(keys[i], i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if i%20 == 0 {
+				cmap.Put(keys[i%len(keys)], i)
+			} else {
+				cmap.Get(keys[i%len(keys)])
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCMapGetParallelMutex(b *testing.B) {
+	benchmarkCMapGetParallel(b)
+}
+
+func BenchmarkCMapGetParallelRWMutex(b *testing.B) {
+	benchmarkCMapGetParallel(b, WithRWLock())
+}
+
+func Test_CMapCompute(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	increment := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, false
+		}
+		return old.(int) + 1, false
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cmap.Compute("hits", increment)
+			}
+		}()
+	}
+	wg.Wait()
+	if e := cmap.Get("hits"); e != 1000 {
+		t.Fatalf("element of hits: expected 1000, got %v", e)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+	cmap.Compute("hits", func(old interface{}, exists bool) (interface{}, bool) {
+		return nil, true
+	})
+	if cmap.Get("hits") != nil || cmap.Len() != 0 {
+		t.Fatalf("compute with delete did not remove the key")
+	}
+}
+
+func Test_CMapClear(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	cmap.Clear()
+	if l := cmap.Len(); l != 0 {
+		t.Fatalf("len after clear: expected 0, got %d", l)
+	}
+	for i := 0; i < 1000; i++ {
+		if e := cmap.Get(fmt.Sprintf("k%d", i)); e != nil {
+			t.Fatalf("element of k%d after clear: expected nil, got %v", i, e)
+		}
+	}
+	cmap.Put("a", 1)
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len after put: expected 1, got %d", l)
+	}
+}
+
+func Test_BucketDelete(t *testing.T) {
+	b := newBucket()
+	for i := 0; i < 5; i++ {
+		p, _ := newPair(fmt.Sprintf("k%d", i), i)
+		b.Put(p, nil)
+	}
+	// 依次删除链表中间、表头和表尾的键-元素对
+	for _, key := range []string{"k2", "k4", "k0"} {
+		if !b.Delete(key, nil) {
+			t.Fatalf("delete %s: expected true", key)
+		}
+	}
+	if b.Delete("k2", nil) {
+		t.Fatalf("delete k2 twice: expected false")
+	}
+	if b.Size() != 2 || b.Get("k1") == nil || b.Get("k3") == nil {
+		t.Fatalf("unexpected bucket after deletion: %s", b)
+	}
+	b.Delete("k1", nil)
+	b.Delete("k3", nil)
+	if b.GetFirstPair() != nil || b.Size() != 0 {
+		t.Fatalf("bucket is not empty: %s", b)
+	}
+}
+
+func Test_BucketDeleteWithConcurrentReaders(t *testing.T) {
+	b := newBucket()
+	for i := 0; i < 50; i++ {
+		p, _ := newPair(fmt.Sprintf("stable%d", i), i)
+		b.Put(p, nil)
+	}
+	var lock sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("churn%d", i%10)
+			p, _ := newPair(key, i)
+			b.Put(p, &lock)
+			b.Delete(key, &lock)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for i := 0; i < 50; i++ {
+			if b.Get(fmt.Sprintf("stable%d", i)) == nil {
+				t.Fatalf("stable%d is unreachable during deletions", i)
+			}
+		}
+	}
+}
+
+func BenchmarkBucketDelete(b *testing.B) {
+	bucket := newBucket()
+	for i := 0; i < 100; i++ {
+		p, _ := newPair(fmt.Sprintf("k%d", i), i)
+		bucket.Put(p, nil)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Put总是放在表头，因此最早放入的k{i}始终位于链表的末尾，
+		// 每次删除都要越过其余99个键 - 元素对
+		b.StopTimer()
+		key := fmt.Sprintf("k%d", i)
+		b.StartTimer()
+		bucket.Delete(key, nil)
+		// 放入一个新的键使链表长度保持不变，这部分不计入结果
+		b.StopTimer()
+		p, _ := newPair(fmt.Sprintf("k%d", i+100), i)
+		bucket.Put(p, nil)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkBucketDeletePosition 展示写时复制的删除代价随目标位置的变化：
+// 删除位于第k个位置（从0开始）的键-元素对需要为它之前的k个键-元素对各分配一个副本
+func BenchmarkBucketDeletePosition(b *testing.B) {
+	for _, position := range []int{0, 50, 99} {
+		b.Run(fmt.Sprintf("position-%d", position), func(b *testing.B) {
+			bucket := newBucket()
+			// order按从表头到表尾的顺序记录键
+			var order []string
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("k%d", i)
+				p, _ := newPair(key, i)
+				bucket.Put(p, nil)
+				order = append([]string{key}, order...)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := order[position]
+				bucket.Delete(key, nil)
+				// 在表头放入一个新的键使链表长度保持不变，这部分不计入结果
+				b.StopTimer()
+				order = append(order[:position], order[position+1:]...)
+				newKey := fmt.Sprintf("n%d", i)
+				p, _ := newPair(newKey, i)
+				bucket.Put(p, nil)
+				order = append([]string{newKey}, order...)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func Test_CMapContains(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithClock(clock.Now))
+	defer cmap.Close()
+	cmap.Put("a", 1)
+	cmap.PutWithTTL("b", 2, time.Millisecond)
+	if !cmap.Contains("a") || cmap.Contains("missing") || !cmap.Contains("b") {
+		t.Fatalf("contains: unexpected result")
+	}
+	clock.Advance(time.Millisecond)
+	if cmap.Contains("b") {
+		t.Fatalf("contains expired b: expected false")
+	}
+}
+
+type gobPoint struct {
+	X, Y int
+}
+
+func Test_CMapGob(t *testing.T) {
+	gob.Register(gobPoint{})
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), gobPoint{X: i, Y: -i})
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmap); err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	other, _ := NewConcurrentMap(4, nil)
+	other.Put("stale", 1)
+	if err := gob.NewDecoder(&buf).Decode(other); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if l := other.Len(); l != 100 {
+		t.Fatalf("len after decode: expected 100, got %d", l)
+	}
+	if e := other.Get("k7"); e != (gobPoint{X: 7, Y: -7}) {
+		t.Fatalf("element of k7: unexpected %v", e)
+	}
+	if other.Contains("stale") {
+		t.Fatalf("decode did not replace existing contents")
+	}
+}
+
+func Test_CMapGobKeepsTTLAndVersion(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	defer cmap.Close()
+	cmap.PutWithTTL("expiring", 1, time.Hour)
+	cmap.Put("versioned", 1)
+	cmap.Put("versioned", 2)
+	cmap.Put("versioned", 3)
+	data, err := cmap.(*myConcurrentMap).GobEncode()
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	other, _ := NewConcurrentMap(8, nil)
+	defer other.Close()
+	if err := other.(*myConcurrentMap).GobDecode(data); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if _, version, ok := other.GetWithVersion("versioned"); !ok || version != 3 {
+		t.Fatalf("version after decode: expected 3, got %d", version)
+	}
+	if !other.PutIfVersion("versioned", 4, 3) {
+		t.Fatalf("put if version after decode: expected the encoded version to be accepted")
+	}
+	m := other.(*myConcurrentMap)
+	keyHash := m.opts.hashFunc("expiring")
+	s := m.findSegment(keyHash)
+	s.Lock()
+	p := s.GetLocked("expiring", keyHash)
+	s.Unlock()
+	if ttl := pairTTL(p); ttl != int64(time.Hour) {
+		t.Fatalf("ttl after decode: expected %d, got %d", int64(time.Hour), ttl)
+	}
+}
+
+func Test_CMapWithMaxSize(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithMaxSize(0)); err == nil {
+		t.Fatalf("zero max size: expected error")
+	}
+	cmap, _ := NewConcurrentMap(16, nil, WithMaxSize(3))
+	cmap.Put("a", 1)
+	cmap.Put("b", 2)
+	cmap.Put("c", 3)
+	cmap.Get("a")
+	cmap.Put("d", 4)
+	if cmap.Contains("b") {
+		t.Fatalf("least recently used key b was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !cmap.Contains(key) {
+			t.Fatalf("key %s was evicted unexpectedly", key)
+		}
+	}
+	cmap.Put("c", 30)
+	cmap.Put("e", 5)
+	if cmap.Contains("a") || cmap.Len() != 3 {
+		t.Fatalf("key a should be evicted: keys=%v", cmap.Keys())
+	}
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if l := cmap.Len(); l != 3 {
+		t.Fatalf("len: expected 3, got %d", l)
+	}
+}
+
+func Test_CMapWithMaxSizeAcrossShards(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil, WithMaxSize(10))
+	for i := 0; i < 10; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < 5; i++ {
+		cmap.Get(fmt.Sprintf("k%d", i))
+	}
+	for i := 10; i < 15; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < 15; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if evicted := i >= 5 && i < 10; cmap.Contains(key) == evicted {
+			t.Fatalf("key %s: expected evicted=%v, keys=%v", key, evicted, cmap.Keys())
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i%50)
+				cmap.Put(key, i)
+				cmap.Get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if l := cmap.Len(); l > 10 {
+		t.Fatalf("len after concurrent puts: expected at most 10, got %d", l)
+	}
+	if err := cmap.CheckInvariants(); err != nil {
+		t.Fatalf("invariants after concurrent puts: %s", err)
+	}
+}
+
+type countingObserver struct {
+	puts, inserts, hits, misses, found, notFound, resizes int64
+}
+
+func (o *countingObserver) OnPut(inserted bool) {
+	atomic.AddInt64(&o.puts, 1)
+	if inserted {
+		atomic.AddInt64(&o.inserts, 1)
+	}
+}
+
+func (o *countingObserver) OnGet(hit bool) {
+	if hit {
+		atomic.AddInt64(&o.hits, 1)
+	} else {
+		atomic.AddInt64(&o.misses, 1)
+	}
+}
+
+func (o *countingObserver) OnDelete(found bool) {
+	if found {
+		atomic.AddInt64(&o.found, 1)
+	} else {
+		atomic.AddInt64(&o.notFound, 1)
+	}
+}
+
+func (o *countingObserver) OnResize(oldBuckets, newBuckets int) {
+	atomic.AddInt64(&o.resizes, 1)
+}
+
+func Test_CMapWithObserver(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithObserver(nil)); err == nil {
+		t.Fatalf("nil observer: expected error")
+	}
+	observer := &countingObserver{}
+	cmap, _ := NewConcurrentMap(1, nil, WithObserver(observer))
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	cmap.Put("k0", 0)
+	cmap.Get("k0")
+	cmap.Get("missing")
+	cmap.Delete("k0")
+	cmap.Delete("k0")
+	if observer.puts != 101 || observer.inserts != 100 {
+		t.Fatalf("puts: %d, inserts: %d", observer.puts, observer.inserts)
+	}
+	if observer.hits != 1 || observer.misses != 1 {
+		t.Fatalf("hits: %d, misses: %d", observer.hits, observer.misses)
+	}
+	if observer.found != 1 || observer.notFound != 1 {
+		t.Fatalf("found: %d, not found: %d", observer.found, observer.notFound)
+	}
+	if observer.resizes == 0 {
+		t.Fatalf("resizes: expected at least one")
+	}
+}
+
+func Test_CMapPutAll(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	m := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		m[fmt.Sprintf("k%d", i)] = i
+	}
+	if err := cmap.PutAll(m); err != nil {
+		t.Fatalf("put all: %s", err)
+	}
+	if l := cmap.Len(); l != 100 {
+		t.Fatalf("len: expected 100, got %d", l)
+	}
+	// nil元素是合法的元素
+	if err := cmap.PutAll(map[string]interface{}{"nil": nil, "good": 1}); err != nil {
+		t.Fatalf("put all with nil element: %s", err)
+	}
+	if cmap.Get("good") != 1 || !cmap.Contains("nil") {
+		t.Fatalf("put all with nil element: expected both keys")
+	}
+}
+
+func Test_CMapToMap(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	m := cmap.ToMap()
+	if len(m) != 100 {
+		t.Fatalf("to map: expected 100 entries, got %d", len(m))
+	}
+	for key, element := range m {
+		if cmap.Get(key) != element {
+			t.Fatalf("to map: element of %s mismatched", key)
+		}
+	}
+}
+
+func Test_CMapWithInitialBuckets(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithInitialBuckets(0)); err == nil {
+		t.Fatalf("zero initial buckets: expected error")
+	}
+	cmap, _ := NewConcurrentMap(2, nil, WithInitialBuckets(100))
+	if buckets := len(cmap.BucketStats()); buckets != 2*128 {
+		t.Fatalf("bucket count: expected %d, got %d", 2*128, buckets)
+	}
+}
+
+func Test_BucketPairs(t *testing.T) {
+	b := newBucket()
+	if pairs := b.Pairs(); len(pairs) != 0 {
+		t.Fatalf("pairs of empty bucket: %v", pairs)
+	}
+	for i := 0; i < 3; i++ {
+		p, _ := newPair(fmt.Sprintf("k%d", i), i)
+		b.Put(p, nil)
+	}
+	b.Delete("k1", nil)
+	pairs := b.Pairs()
+	if len(pairs) != 2 || pairs[0].Key() != "k2" || pairs[1].Key() != "k0" {
+		t.Fatalf("unexpected pairs: %v", pairs)
+	}
+	b.Clear(nil)
+	if pairs := b.Pairs(); len(pairs) != 0 {
+		t.Fatalf("pairs of cleared bucket: %v", pairs)
+	}
+}
+
+func Test_BucketPutResetsStaleNext(t *testing.T) {
+	b := newBucket()
+	stale, _ := newPair("stale", 0)
+	p, _ := newPair("a", 1)
+	p.SetNext(stale)
+	b.Put(p, nil)
+	if b.Get("stale") != nil || len(b.Pairs()) != 1 {
+		t.Fatalf("stale next was linked into the bucket: %s", b)
+	}
+	b.Delete("a", nil)
+	q, _ := newPair("b", 2)
+	q.SetNext(stale)
+	b.PutIfAbsent(q, nil)
+	if b.Get("stale") != nil || b.Size() != 1 {
+		t.Fatalf("stale next was linked into the bucket: %s", b)
+	}
+}
+
+func Test_CMapCompact(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	number := 20000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	cmap.Compact()
+	grownBuckets := len(cmap.BucketStats())
+	for i := 0; i < number; i++ {
+		if i%10 != 0 {
+			cmap.Delete(fmt.Sprintf("k%d", i))
+		}
+	}
+	cmap.Compact()
+	buckets := len(cmap.BucketStats())
+	if buckets >= grownBuckets {
+		t.Fatalf("bucket count did not shrink: %d -> %d", grownBuckets, buckets)
+	}
+	for i := 0; i < number; i += 10 {
+		if e := cmap.Get(fmt.Sprintf("k%d", i)); e != i {
+			t.Fatalf("element of k%d: expected %d, got %v", i, i, e)
+		}
+	}
+	cmap.Compact()
+	if again := len(cmap.BucketStats()); again != buckets {
+		t.Fatalf("compacting a compacted map changed its bucket count: %d -> %d", buckets, again)
+	}
+}
+
+func Test_CMapString(t *testing.T) {
+	cmap, _ := NewConcurrentMap(1, nil)
+	cmap.Put("a", 1)
+	str := cmap.String()
+	if !strings.Contains(str, "key:a") || !strings.HasPrefix(str, "cmap{") {
+		t.Fatalf("unexpected string: %s", str)
+	}
+	limited, _ := NewConcurrentMap(1, nil, WithStringLimit(1))
+	for i := 0; i < 100; i++ {
+		limited.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if str := limited.String(); !strings.Contains(str, "omitted") || strings.Count(str, "pair{") >= 100 {
+		t.Fatalf("string was not truncated: %s", str)
+	}
+}
+
+func Test_CMapRangePrefix(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 10; i++ {
+		cmap.Put(fmt.Sprintf("user:%d", i), i)
+		cmap.Put(fmt.Sprintf("order:%d", i), i)
+	}
+	var count int
+	cmap.RangePrefix("user:", func(key string, element interface{}) bool {
+		if !strings.HasPrefix(key, "user:") {
+			t.Fatalf("unexpected key %s", key)
+		}
+		count++
+		return true
+	})
+	if count != 10 {
+		t.Fatalf("range prefix: expected 10 keys, got %d", count)
+	}
+	count = 0
+	cmap.RangePrefix("order:", func(key string, element interface{}) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Fatalf("range prefix stop: expected 3 calls, got %d", count)
+	}
+}
+
+func Test_CMapDeletePrefix(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("user:%d", i), i)
+		cmap.Put(fmt.Sprintf("order:%d", i), i)
+	}
+	if deleted := cmap.DeletePrefix("user:"); deleted != 100 {
+		t.Fatalf("deleted: expected 100, got %d", deleted)
+	}
+	if l := cmap.Len(); l != 100 {
+		t.Fatalf("len: expected 100, got %d", l)
+	}
+	if cmap.Contains("user:1") || !cmap.Contains("order:1") {
+		t.Fatalf("delete prefix removed the wrong keys")
+	}
+}
+
+func Test_CMapWithEvictionCallback(t *testing.T) {
+	var lock sync.Mutex
+	evicted := make(map[string]interface{})
+	var cmap ConcurrentMap
+	clock := newFakeClock()
+	cmap, _ = NewConcurrentMap(16, nil, WithMaxSize(10), WithClock(clock.Now), WithEvictionCallback(func(key string, element interface{}) {
+		// 回调在释放锁之后执行，可以安全地访问字典
+		cmap.Contains(key)
+		lock.Lock()
+		evicted[key] = element
+		lock.Unlock()
+	}))
+	defer cmap.Close()
+	cmap.Put("deleted", 1)
+	cmap.Delete("deleted")
+	cmap.Put("overwritten", 1)
+	cmap.Put("overwritten", 2)
+	cmap.PutWithTTL("expired", 1, time.Millisecond)
+	clock.Advance(time.Millisecond)
+	cmap.Get("expired")
+	for i := 0; i < 10; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	cmap.Clear()
+	if evicted["deleted"] != 1 || evicted["overwritten"] != 2 || evicted["expired"] != 1 {
+		t.Fatalf("unexpected evictions: %v", evicted)
+	}
+	if len(evicted) != 13 {
+		t.Fatalf("evictions: expected 13 keys, got %d (%v)", len(evicted), evicted)
+	}
+}
+
+func Test_CMapReplace(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if cmap.Replace("a", 1) || cmap.Contains("a") {
+		t.Fatalf("replace absent key: expected no-op")
+	}
+	cmap.Put("a", 1)
+	if !cmap.Replace("a", 2) || cmap.Get("a") != 2 {
+		t.Fatalf("replace present key: expected element 2, got %v", cmap.Get("a"))
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapCompareAndSwap(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if cmap.CompareAndSwap("a", 1, 2, nil) {
+		t.Fatalf("compare and swap absent key: expected false")
+	}
+	cmap.Put("a", 1)
+	if cmap.CompareAndSwap("a", 3, 2, nil) || cmap.Get("a") != 1 {
+		t.Fatalf("compare and swap mismatched: expected no change")
+	}
+	if !cmap.CompareAndSwap("a", 1, 2, nil) || cmap.Get("a") != 2 {
+		t.Fatalf("compare and swap matched: expected element 2")
+	}
+	cmap.Put("s", []int{1})
+	sliceEq := func(a, b interface{}) bool {
+		return len(a.([]int)) == len(b.([]int))
+	}
+	if !cmap.CompareAndSwap("s", []int{9}, []int{1, 2}, sliceEq) {
+		t.Fatalf("compare and swap with comparator: expected true")
+	}
+}
+
+func Test_CMapCompareAndDelete(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	if cmap.CompareAndDelete("a", 2, nil) || cmap.Len() != 1 {
+		t.Fatalf("compare and delete mismatched: expected no change")
+	}
+	if !cmap.CompareAndDelete("a", 1, nil) || cmap.Contains("a") {
+		t.Fatalf("compare and delete matched: expected deletion")
+	}
+	if l := cmap.Len(); l != 0 {
+		t.Fatalf("len: expected 0, got %d", l)
+	}
+	if cmap.CompareAndDelete("a", 1, nil) {
+		t.Fatalf("compare and delete absent key: expected false")
+	}
+}
+
+func Test_CMapWithConsistentHashing(t *testing.T) {
+	cmap, _ := NewConcurrentMap(2, nil, WithConsistentHashing(), WithInitialBuckets(2))
+	number := 2000
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	for i := 0; i < number; i++ {
+		if e := cmap.Get(fmt.Sprintf("key-%d", i)); e != i {
+			t.Fatalf("element of key-%d is %v after resizes, expected %d", i, e, i)
+		}
+	}
+	for i := 0; i < number; i += 2 {
+		cmap.Delete(fmt.Sprintf("key-%d", i))
+	}
+	cmap.Compact()
+	if cmap.Len() != uint64(number/2) {
+		t.Fatalf("len is %d, expected %d", cmap.Len(), number/2)
+	}
+	for i := 1; i < number; i += 2 {
+		if e := cmap.Get(fmt.Sprintf("key-%d", i)); e != i {
+			t.Fatalf("element of key-%d is %v after compact, expected %d", i, e, i)
+		}
+	}
+}
+
+// benchmarkKeysMoved 统计散列桶数量从16按照grow扩容到1024的过程中，
+// 每次扩容平均有多大比例的键换到了别的散列桶
+func benchmarkKeysMoved(b *testing.B, pr *myPairRedistributor) {
+	hashes := make([]uint64, 10000)
+	for i := range hashes {
+		hashes[i] = hash(fmt.Sprintf("key-%d", i))
+	}
+	var moved, total int
+	for n := 0; n < b.N; n++ {
+		for current := uint64(16); current < 1024; {
+			next := pr.grow(current)
+			for _, h := range hashes {
+				if pr.BucketIndex(h, int(current)) != pr.BucketIndex(h, int(next)) {
+					moved++
+				}
+			}
+			total += len(hashes)
+			current = next
+		}
+	}
+	b.ReportMetric(float64(moved)/float64(total), "moved/key")
+}
+
+func BenchmarkKeysMovedModulo(b *testing.B) {
+	benchmarkKeysMoved(b, newDefaultPairRedistributor(0, 16).(*myPairRedistributor))
+}
+
+func BenchmarkKeysMovedConsistent(b *testing.B) {
+	benchmarkKeysMoved(b, newConsistentPairRedistributor(0, 16).(*myPairRedistributor))
+}
+
+func Test_CMapSnapshot(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	number := 500
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	snap := cmap.Snapshot()
+	for i := 0; i < number; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if i%2 == 0 {
+			cmap.Delete(key)
+		} else {
+			cmap.Put(key, -i)
+		}
+	}
+	for i := number; i < number*4; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	if snap.Len() != uint64(number) {
+		t.Fatalf("snapshot len is %d, expected %d", snap.Len(), number)
+	}
+	for i := 0; i < number; i++ {
+		if e := snap.Get(fmt.Sprintf("key-%d", i)); e != i {
+			t.Fatalf("snapshot element of key-%d is %v, expected %d", i, e, i)
+		}
+	}
+	if e := snap.Get(fmt.Sprintf("key-%d", number)); e != nil {
+		t.Fatalf("snapshot sees key-%d written later: %v", number, e)
+	}
+	var count int
+	snap.Range(func(key string, element interface{}) bool {
+		if element.(int) < 0 {
+			t.Fatalf("snapshot range sees later write %s=%v", key, element)
+		}
+		count++
+		return true
+	})
+	if count != number {
+		t.Fatalf("snapshot range visited %d pairs, expected %d", count, number)
+	}
+}
+
+func Test_CMapWithPairPool(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil, WithPairPool())
+	number := 200
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				for i := 0; i < number; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					if n%3 == 2 {
+						cmap.Delete(key)
+					} else {
+						cmap.Put(key, i)
+					}
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				for i := 0; i < number; i++ {
+					if e := cmap.Get(fmt.Sprintf("key-%d", i)); e != nil && e != i {
+						t.Errorf("element of key-%d is %v, expected %d", i, e, i)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	snap := cmap.Snapshot()
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), -i)
+	}
+	snap.Range(func(key string, element interface{}) bool {
+		if element.(int) < 0 {
+			t.Fatalf("snapshot sees reused pair %s=%v", key, element)
+		}
+		return true
+	})
+}
+
+func benchmarkCMapPutChurn(b *testing.B, opts ...Option) {
+	cmap, _ := NewConcurrentMap(16, nil, opts...)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		cmap.Put(keys[i], i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		key := keys[n%len(keys)]
+		cmap.Put(key, n)
+		if n%4 == 0 {
+			cmap.Delete(key)
+		}
+	}
+}
+
+func BenchmarkCMapPutChurn(b *testing.B) {
+	benchmarkCMapPutChurn(b)
+}
+
+func BenchmarkCMapPutChurnPairPool(b *testing.B) {
+	benchmarkCMapPutChurn(b, WithPairPool())
+}
+
+func Test_CMapSwap(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if previous, loaded := cmap.Swap("a", 1); loaded || previous != nil {
+		t.Fatalf("swap absent key: expected (nil, false), got (%v, %v)", previous, loaded)
+	}
+	if previous, loaded := cmap.Swap("a", 2); !loaded || previous != 1 {
+		t.Fatalf("swap present key: expected (1, true), got (%v, %v)", previous, loaded)
+	}
+	if e := cmap.Get("a"); e != 2 {
+		t.Fatalf("element after swap: expected 2, got %v", e)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapLoadAndDelete(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	number := 100
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	var claimed int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < number; i++ {
+				if _, loaded := cmap.LoadAndDelete(fmt.Sprintf("key-%d", i)); loaded {
+					atomic.AddInt64(&claimed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != int64(number) {
+		t.Fatalf("claimed %d keys, expected %d", claimed, number)
+	}
+	if l := cmap.Len(); l != 0 {
+		t.Fatalf("len: expected 0, got %d", l)
+	}
+	if element, loaded := cmap.LoadAndDelete("key-0"); loaded || element != nil {
+		t.Fatalf("load and delete absent key: expected (nil, false), got (%v, %v)", element, loaded)
+	}
+}
+
+func Test_CMapSaveTo(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	number := 50
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	encode := func(key string, element interface{}) ([]byte, error) {
+		return []byte(fmt.Sprintf("%s=%d", key, element)), nil
+	}
+	var buf bytes.Buffer
+	n, err := cmap.SaveTo(&buf, encode)
+	if err != nil {
+		t.Fatalf("write to error: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("written bytes: expected %d, got %d", buf.Len(), n)
+	}
+	var records int
+	for buf.Len() > 0 {
+		length, err := binary.ReadUvarint(&buf)
+		if err != nil {
+			t.Fatalf("read record length error: %s", err)
+		}
+		record := string(buf.Next(int(length)))
+		if !strings.HasPrefix(record, "key-") {
+			t.Fatalf("unexpected record %q", record)
+		}
+		records++
+	}
+	if records != number {
+		t.Fatalf("records: expected %d, got %d", number, records)
+	}
+	encodeErr := fmt.Errorf("encode failed")
+	_, err = cmap.SaveTo(&buf, func(key string, element interface{}) ([]byte, error) {
+		return nil, encodeErr
+	})
+	if err != encodeErr {
+		t.Fatalf("write to with failing encode: expected %v, got %v", encodeErr, err)
+	}
+}
+
+func Test_CMapLoadFrom(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	number := 50
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	encode := func(key string, element interface{}) ([]byte, error) {
+		return []byte(key + "=" + element.(string)), nil
+	}
+	decode := func(record []byte) (string, interface{}, error) {
+		parts := strings.SplitN(string(record), "=", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("missing separator")
+		}
+		return parts[0], parts[1], nil
+	}
+	var buf bytes.Buffer
+	written, _ := cmap.SaveTo(&buf, encode)
+	data := buf.Bytes()
+	loaded, _ := NewConcurrentMap(4, nil)
+	n, err := loaded.LoadFrom(bytes.NewReader(data), decode)
+	if err != nil {
+		t.Fatalf("read from error: %s", err)
+	}
+	if n != written {
+		t.Fatalf("read bytes: expected %d, got %d", written, n)
+	}
+	if !reflect.DeepEqual(loaded.ToMap(), cmap.ToMap()) {
+		t.Fatalf("loaded map differs: %v", loaded.ToMap())
+	}
+	_, err = loaded.LoadFrom(bytes.NewReader(data[:len(data)-1]), decode)
+	if _, ok := err.(CorruptRecordError); !ok {
+		t.Fatalf("read truncated data: expected CorruptRecordError, got %v", err)
+	}
+	_, err = loaded.LoadFrom(bytes.NewReader([]byte{3, 'a', 'b', 'c'}), decode)
+	if _, ok := err.(CorruptRecordError); !ok {
+		t.Fatalf("read undecodable record: expected CorruptRecordError, got %v", err)
+	}
+}
+
+func Test_CMapEqualAndDiff(t *testing.T) {
+	left, _ := NewConcurrentMap(4, nil)
+	right, _ := NewConcurrentMap(8, nil)
+	for i := 0; i < 20; i++ {
+		left.Put(fmt.Sprintf("key-%02d", i), i)
+		right.Put(fmt.Sprintf("key-%02d", i), i)
+	}
+	if !left.Equal(right, nil) || !right.Equal(left, nil) {
+		t.Fatalf("maps with the same pairs: expected equal")
+	}
+	left.Put("only-left", 1)
+	right.Put("only-right", 1)
+	right.Put("key-03", -3)
+	if left.Equal(right, nil) {
+		t.Fatalf("maps with different pairs: expected not equal")
+	}
+	onlyLeft, onlyRight, changed := left.Diff(right)
+	if !reflect.DeepEqual(onlyLeft, []string{"only-left"}) ||
+		!reflect.DeepEqual(onlyRight, []string{"only-right"}) ||
+		!reflect.DeepEqual(changed, []string{"key-03"}) {
+		t.Fatalf("diff: got onlyLeft=%v onlyRight=%v changed=%v", onlyLeft, onlyRight, changed)
+	}
+}
+
+func Test_CMapDiffSliceElements(t *testing.T) {
+	left, _ := NewConcurrentMap(4, nil)
+	right, _ := NewConcurrentMap(4, nil)
+	for _, m := range []ConcurrentMap{left, right} {
+		m.Append("same", 1, 2)
+		m.Append("changed", 1)
+	}
+	right.Append("changed", 2)
+	_, _, changed := left.Diff(right)
+	if !reflect.DeepEqual(changed, []string{"changed"}) {
+		t.Fatalf("diff of slice elements: expected [changed], got %v", changed)
+	}
+	if left.Equal(right, nil) {
+		t.Fatalf("equal of differing slice elements: expected not equal")
+	}
+	right.Append("changed", -2)
+	left.Append("changed", 2, -2)
+	if !left.Equal(right, nil) {
+		t.Fatalf("equal of identical slice elements: expected equal")
+	}
+	if _, _, changed := left.Diff(right); len(changed) != 0 {
+		t.Fatalf("diff of identical slice elements: expected no changes, got %v", changed)
+	}
+	alwaysEqual := func(a, b interface{}) bool { return true }
+	right.Append("changed", 3)
+	if !left.Equal(right, alwaysEqual) {
+		t.Fatalf("equal with custom eq: expected equal")
+	}
+}
+
+func Test_CMapParallelRange(t *testing.T) {
+	cmap, _ := NewConcurrentMap(8, nil)
+	number := 1000
+	var expected int64
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+		expected += int64(i)
+	}
+	var sum, count int64
+	cmap.ParallelRange(4, func(key string, element interface{}) {
+		atomic.AddInt64(&sum, int64(element.(int)))
+		atomic.AddInt64(&count, 1)
+	})
+	if count != int64(number) || sum != expected {
+		t.Fatalf("parallel range visited %d pairs with sum %d, expected %d and %d", count, sum, number, expected)
+	}
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Fatalf("parallel range panic: expected boom, got %v", p)
+		}
+	}()
+	cmap.ParallelRange(4, func(key string, element interface{}) {
+		if element.(int) == number/2 {
+			panic("boom")
+		}
+	})
+	t.Fatalf("parallel range: expected panic to propagate")
+}
+
+func Test_Map(t *testing.T) {
+	if _, err := NewMap[int, int](16, nil); err == nil {
+		t.Fatalf("new map with nil hash function: expected error")
+	}
+	m, _ := NewMap[int, string](4, func(key int) uint64 { return uint64(key) })
+	number := 2000
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < number; i += 4 {
+				if !m.Put(i, fmt.Sprint(i)) {
+					t.Errorf("put %d: expected new key", i)
+				}
+				if v, ok := m.Get(i); !ok || v != fmt.Sprint(i) {
+					t.Errorf("get %d: got (%q, %v)", i, v, ok)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if m.Len() != uint64(number) {
+		t.Fatalf("len: expected %d, got %d", number, m.Len())
+	}
+	if m.Put(7, "seven") {
+		t.Fatalf("put existing key: expected overwrite")
+	}
+	if v, _ := m.Get(7); v != "seven" {
+		t.Fatalf("get overwritten key: expected seven, got %q", v)
+	}
+	for i := 0; i < number; i += 2 {
+		if !m.Delete(i) {
+			t.Fatalf("delete %d: expected true", i)
+		}
+	}
+	if _, ok := m.Get(0); ok || m.Delete(0) {
+		t.Fatalf("deleted key 0 still present")
+	}
+	var count int
+	m.Range(func(key int, element string) bool {
+		if key%2 == 0 {
+			t.Fatalf("range visited deleted key %d", key)
+		}
+		count++
+		return true
+	})
+	if count != number/2 || m.Len() != uint64(number/2) {
+		t.Fatalf("after deletes: visited %d, len %d, expected %d", count, m.Len(), number/2)
+	}
+}
+
+func Test_CMapPutIsNew(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if isNew, err := cmap.Put("a", 1); err != nil || !isNew {
+		t.Fatalf("first put: expected (true, nil), got (%v, %v)", isNew, err)
+	}
+	if isNew, err := cmap.Put("a", 2); err != nil || isNew {
+		t.Fatalf("second put: expected (false, nil), got (%v, %v)", isNew, err)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapWithMaxChainLength(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithMaxChainLength(0)); err == nil {
+		t.Fatalf("new concurrent map with zero max chain length: expected error")
+	}
+	// 散列值都是16的倍数，初始的16个散列桶中只有一个会被用到
+	collide := WithHashFunc(func(key string) uint64 {
+		var i uint64
+		fmt.Sscanf(key, "key-%d", &i)
+		return i * 16
+	})
+	maxBucketSize := func(cmap ConcurrentMap) uint64 {
+		var max uint64
+		for _, size := range cmap.BucketStats() {
+			if size > max {
+				max = size
+			}
+		}
+		return max
+	}
+	number := 1000
+	plain, _ := NewConcurrentMap(1, nil, collide, WithLoadFactor(1000))
+	bounded, _ := NewConcurrentMap(1, nil, collide, WithLoadFactor(1000), WithMaxChainLength(100))
+	for i := 0; i < number; i++ {
+		plain.Put(fmt.Sprintf("key-%d", i), i)
+		bounded.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	if max := maxBucketSize(plain); max != uint64(number) {
+		t.Fatalf("longest chain without limit: expected %d, got %d", number, max)
+	}
+	if max := maxBucketSize(bounded); max > 100 {
+		t.Fatalf("longest chain with limit 100: got %d", max)
+	}
+	for i := 0; i < number; i++ {
+		if e := bounded.Get(fmt.Sprintf("key-%d", i)); e != i {
+			t.Fatalf("element of key-%d is %v, expected %d", i, e, i)
+		}
+	}
+}
+
+func Test_BucketConcurrentPutWithoutLock(t *testing.T) {
+	b := newBucket()
+	number := 200
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < number; i += 4 {
+				p, _ := newPair(fmt.Sprintf("key-%d", i), i)
+				b.Put(p, nil)
+				if i%8 == 0 {
+					b.Delete(p.Key(), nil)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	expected := uint64(number - number/8)
+	if b.Size() != expected || uint64(len(b.Pairs())) != expected {
+		t.Fatalf("bucket size %d with %d pairs, expected %d", b.Size(), len(b.Pairs()), expected)
+	}
+}
+
+func Test_CMapLoad(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	if element, ok := cmap.Load("a"); !ok || element != 1 {
+		t.Fatalf("load hit: expected (1, true), got (%v, %v)", element, ok)
+	}
+	if element, ok := cmap.Load("b"); ok || element != nil {
+		t.Fatalf("load miss: expected (nil, false), got (%v, %v)", element, ok)
+	}
+}
+
+func Test_CMapStats(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	cmap.Put("a", 2)
+	cmap.PutIfAbsent("b", 1)
+	cmap.Get("a")
+	cmap.Get("c")
+	cmap.Delete("a")
+	cmap.Delete("a")
+	expected := Stats{Puts: 3, Gets: 2, Hits: 1, Misses: 1, Deletes: 2}
+	if stats := cmap.Stats(); stats != expected {
+		t.Fatalf("stats: expected %+v, got %+v", expected, stats)
+	}
+	cmap.ResetStats()
+	cmap.Compute("c", func(old interface{}, exists bool) (interface{}, bool) { return 1, false })
+	cmap.Replace("c", 2)
+	cmap.Replace("absent", 1)
+	cmap.Swap("c", 3)
+	cmap.CompareAndSwap("c", 3, 4, nil)
+	cmap.CompareAndSwap("c", 3, 5, nil)
+	cmap.Increment("n", 1)
+	cmap.Append("list", 1)
+	cmap.GetOrPut("d", func() interface{} { return 1 })
+	cmap.GetOrPut("d", func() interface{} { return 2 })
+	cmap.LoadAndDelete("c")
+	cmap.LoadAndDelete("c")
+	cmap.CompareAndDelete("d", 2, nil)
+	cmap.CompareAndDelete("d", 1, nil)
+	cmap.Compute("n", func(old interface{}, exists bool) (interface{}, bool) { return nil, true })
+	expected = Stats{Puts: 7, Gets: 2, Hits: 1, Misses: 1, Deletes: 4}
+	if stats := cmap.Stats(); stats != expected {
+		t.Fatalf("stats of read-modify-write methods: expected %+v, got %+v", expected, stats)
+	}
+	cmap.ResetStats()
+	if stats := cmap.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats after reset: expected zero, got %+v", stats)
+	}
+}
+
+func Test_CMapWithRefreshOnGet(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithRefreshOnGet(true), WithClock(clock.Now))
+	defer cmap.Close()
+	ttl := 40 * time.Millisecond
+	cmap.PutWithTTL("hot", 1, ttl)
+	cmap.PutWithTTL("idle", 2, ttl)
+	for i := 0; i < 12; i++ {
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cmap.Get("hot")
+			}()
+		}
+		wg.Wait()
+		clock.Advance(ttl / 4)
+	}
+	cmap.(*myConcurrentMap).deleteAllExpired(clock.Now().UnixNano())
+	if e := cmap.Get("hot"); e != 1 {
+		t.Fatalf("element of hot key: expected 1, got %v", e)
+	}
+	if cmap.Contains("idle") {
+		t.Fatalf("idle key: expected expiry")
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len after sweeping: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapErrorsIs(t *testing.T) {
+	_, err := NewConcurrentMap(0, nil)
+	if !errors.Is(err, ErrIllegalParameter) || !errors.Is(err, ErrInvalidConcurrency) {
+		t.Fatalf("invalid concurrency: expected ErrIllegalParameter and ErrInvalidConcurrency, got %v", err)
+	}
+	if _, ok := err.(IllegalParameterError); !ok {
+		t.Fatalf("invalid concurrency: expected IllegalParameterError, got %T", err)
+	}
+	_, err = NewConcurrentMap(1, nil, WithHashFunc(nil))
+	if !errors.Is(err, ErrNilHashFunc) || errors.Is(err, ErrInvalidConcurrency) {
+		t.Fatalf("nil hash function: expected only ErrNilHashFunc, got %v", err)
+	}
+	_, err = NewConcurrentMap(1, nil, WithInitialBuckets(0))
+	if !errors.Is(err, ErrInvalidBucketCount) {
+		t.Fatalf("zero buckets: expected ErrInvalidBucketCount, got %v", err)
+	}
+	if _, err = newBucket().Put(nil, nil); !errors.Is(err, ErrNilPair) {
+		t.Fatalf("nil pair: expected ErrNilPair, got %v", err)
+	}
+}
+
+func Test_CMapTryPut(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	p, _ := newPair("a", 1)
+	if ok, inserted := cmap.TryPut(p); !ok || !inserted {
+		t.Fatalf("try put uncontended: expected (true, true), got (%v, %v)", ok, inserted)
+	}
+	m := cmap.(*myConcurrentMap)
+	s := m.findSegment(m.opts.hashFunc("a")).(*segment)
+	s.lock.Lock()
+	p, _ = newPair("a", 2)
+	ok, _ := cmap.TryPut(p)
+	s.lock.Unlock()
+	if ok {
+		t.Fatalf("try put while segment is locked: expected ok=false")
+	}
+	if e := cmap.Get("a"); e != 1 {
+		t.Fatalf("element after failed try put: expected 1, got %v", e)
+	}
+	if ok, inserted := cmap.TryPut(p); !ok || inserted {
+		t.Fatalf("try put overwrite: expected (true, false), got (%v, %v)", ok, inserted)
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+}
+
+func Test_CMapTryGet(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithRWLock()}} {
+		cmap, _ := NewConcurrentMap(16, nil, opts...)
+		cmap.Put("a", 1)
+		if element, ok, acquired := cmap.TryGet("a"); !acquired || !ok || element != 1 {
+			t.Fatalf("try get uncontended: expected (1, true, true), got (%v, %v, %v)", element, ok, acquired)
+		}
+		if _, ok, acquired := cmap.TryGet("b"); !acquired || ok {
+			t.Fatalf("try get absent key: expected (nil, false, true), got ok=%v acquired=%v", ok, acquired)
+		}
+		m := cmap.(*myConcurrentMap)
+		s := m.findSegment(m.opts.hashFunc("a")).(*segment)
+		s.lock.Lock()
+		_, _, acquired := cmap.TryGet("a")
+		s.lock.Unlock()
+		if acquired {
+			t.Fatalf("try get while segment is write locked: expected acquired=false")
+		}
+	}
+}
+
+func Test_CMapDrain(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	number := 100
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	var visited []string
+	cmap.Drain(func(key string, element interface{}) bool {
+		visited = append(visited, key)
+		return len(visited) < 30
+	})
+	if len(visited) != 30 {
+		t.Fatalf("drain visited %d pairs, expected 30", len(visited))
+	}
+	if l := cmap.Len(); l != uint64(number-30) {
+		t.Fatalf("len after partial drain: expected %d, got %d", number-30, l)
+	}
+	for _, key := range visited {
+		if cmap.Contains(key) {
+			t.Fatalf("drained key %s is still present", key)
+		}
+	}
+	var rest int
+	cmap.Drain(func(key string, element interface{}) bool {
+		rest++
+		return true
+	})
+	if rest != number-30 || cmap.Len() != 0 || len(cmap.Keys()) != 0 {
+		t.Fatalf("full drain visited %d pairs, len %d", rest, cmap.Len())
+	}
+}
+
+func Test_CMapReserve(t *testing.T) {
+	// Reserve假设键在散列段之间均匀分布，因此这里使用分布更均匀的FNV-1a
+	fnv1a := WithHashFunc(func(key string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	})
+	observer := &countingObserver{}
+	cmap, _ := NewConcurrentMap(8, nil, fnv1a, WithObserver(observer))
+	number := 10000
+	cmap.Reserve(uint64(number))
+	reserved := atomic.LoadInt64(&observer.resizes)
+	if reserved == 0 {
+		t.Fatalf("reserve: expected resizes")
+	}
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	if resizes := atomic.LoadInt64(&observer.resizes); resizes != reserved {
+		t.Fatalf("resizes after reserve and load: expected %d, got %d", reserved, resizes)
+	}
+	cmap.Reserve(uint64(number))
+	if resizes := atomic.LoadInt64(&observer.resizes); resizes != reserved {
+		t.Fatalf("reserve on a large enough map: expected no resize, got %d", resizes-reserved)
+	}
+}
+
+func Test_CMapBucketIndex(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		cmap.Put(key, i)
+		stats := cmap.BucketStats()
+		index := cmap.BucketIndex(key)
+		if index < 0 || index >= len(stats) || stats[index] == 0 {
+			t.Fatalf("bucket index of %s is %d, which is not a non-empty bucket", key, index)
+		}
+	}
+	counts := make([]uint64, len(cmap.BucketStats()))
+	for _, key := range cmap.Keys() {
+		counts[cmap.BucketIndex(key)]++
+	}
+	if !reflect.DeepEqual(counts, cmap.BucketStats()) {
+		t.Fatalf("bucket counts from BucketIndex differ from BucketStats")
+	}
+}
+
+func Test_CMapNilElement(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if isNew, err := cmap.Put("present", nil); err != nil || !isNew {
+		t.Fatalf("put nil element: expected (true, nil), got (%v, %v)", isNew, err)
+	}
+	if element, ok := cmap.Load("present"); !ok || element != nil {
+		t.Fatalf("load present but nil: expected (nil, true), got (%v, %v)", element, ok)
+	}
+	if element, ok := cmap.Load("absent"); ok || element != nil {
+		t.Fatalf("load absent: expected (nil, false), got (%v, %v)", element, ok)
+	}
+	if !cmap.Contains("present") || cmap.Contains("absent") {
+		t.Fatalf("contains: expected present only")
+	}
+	if l := cmap.Len(); l != 1 {
+		t.Fatalf("len: expected 1, got %d", l)
+	}
+	if previous, loaded := cmap.Swap("present", 1); !loaded || previous != nil {
+		t.Fatalf("swap nil element: expected (nil, true), got (%v, %v)", previous, loaded)
+	}
+	if isNew, _ := cmap.Put("present", nil); isNew {
+		t.Fatalf("overwrite with nil element: expected isNew=false")
+	}
+	if element, ok := cmap.Snapshot().Load("present"); !ok || element != nil {
+		t.Fatalf("snapshot load present but nil: expected (nil, true), got (%v, %v)", element, ok)
+	}
+	calls := 0
+	newNil := func() interface{} {
+		calls++
+		return nil
+	}
+	if actual, loaded := cmap.GetOrPut("computed", newNil); loaded || actual != nil {
+		t.Fatalf("get or put nil element: expected (nil, false), got (%v, %v)", actual, loaded)
+	}
+	if element, ok := cmap.Load("computed"); !ok || element != nil {
+		t.Fatalf("load nil element put by get or put: expected (nil, true), got (%v, %v)", element, ok)
+	}
+	if actual, loaded := cmap.GetOrPut("computed", newNil); !loaded || actual != nil {
+		t.Fatalf("get or put existing nil element: expected (nil, true), got (%v, %v)", actual, loaded)
+	}
+	if calls != 1 {
+		t.Fatalf("get or put nil element: expected newElement to be called once, got %d", calls)
+	}
+	if l := cmap.Len(); l != 2 {
+		t.Fatalf("len after get or put nil element: expected 2, got %d", l)
+	}
+}
+
+func Test_CMapWithLockStripes(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithLockStripes(0)); err == nil {
+		t.Fatalf("new concurrent map with zero lock stripes: expected error")
+	}
+	cmap, _ := NewConcurrentMap(4, nil, WithLockStripes(4))
+	number := 2000
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < number; i += 4 {
+				cmap.Put(fmt.Sprintf("key-%d", i), i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i := 0; i < number; i++ {
+		if e := cmap.Get(fmt.Sprintf("key-%d", i)); e != i {
+			t.Fatalf("element of key-%d is %v, expected %d", i, e, i)
+		}
+	}
+	for _, s := range cmap.(*myConcurrentMap).segments {
+		locks := make(map[*sync.Mutex]bool)
+		buckets := s.Buckets()
+		for _, b := range buckets {
+			locks[b.(*bucket).lock] = true
+		}
+		if len(buckets) > 4 && len(locks) != 4 {
+			t.Fatalf("%d buckets use %d locks, expected 4", len(buckets), len(locks))
+		}
+	}
+}
+
+func Test_CMapUpdate(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	accounts := 10
+	for i := 0; i < accounts; i++ {
+		cmap.Put(fmt.Sprintf("account-%d", i), 100)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				from := fmt.Sprintf("account-%d", (w+i)%accounts)
+				to := fmt.Sprintf("account-%d", (w*3+i*7+1)%accounts)
+				if from == to {
+					continue
+				}
+				err := cmap.Update([]string{from, to}, func(snapshot map[string]interface{}) map[string]interface{} {
+					return map[string]interface{}{
+						from: snapshot[from].(int) - 1,
+						to:   snapshot[to].(int) + 1,
+					}
+				})
+				if err != nil {
+					t.Errorf("update: %s", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	total := 0
+	for i := 0; i < accounts; i++ {
+		total += cmap.Get(fmt.Sprintf("account-%d", i)).(int)
+	}
+	if total != accounts*100 {
+		t.Fatalf("total after transfers is %d, expected %d", total, accounts*100)
+	}
+	err := cmap.Update([]string{"new", "account-0"}, func(snapshot map[string]interface{}) map[string]interface{} {
+		if _, ok := snapshot["new"]; ok {
+			t.Errorf("snapshot contains absent key")
+		}
+		return map[string]interface{}{"new": 1, "ignored": 2}
+	})
+	if err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if cmap.Len() != uint64(accounts+1) || cmap.Get("new") != 1 || cmap.Get("ignored") != nil {
+		t.Fatalf("update inserting key: unexpected len %d", cmap.Len())
+	}
+}
+
+func Test_CMapFilter(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	even := cmap.Filter(func(key string, element interface{}) bool {
+		return element.(int)%2 == 0
+	})
+	if l := even.Len(); l != 50 {
+		t.Fatalf("len of filtered map: expected 50, got %d", l)
+	}
+	even.Range(func(key string, element interface{}) bool {
+		if element.(int)%2 != 0 {
+			t.Fatalf("filtered map contains %s=%v", key, element)
+		}
+		return true
+	})
+	even.Put("k0", -1)
+	even.Put("extra", 1)
+	if e := cmap.Get("k0"); e != 0 || cmap.Contains("extra") || cmap.Len() != 100 {
+		t.Fatalf("filtered map is not independent of source")
+	}
+}
+
+func Test_CMapMapValues(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	mapped := cmap.MapValues(func(key string, element interface{}) interface{} {
+		return fmt.Sprintf("%s=%d", key, element.(int)*2)
+	})
+	if l := mapped.Len(); l != 100 {
+		t.Fatalf("len of mapped map: expected 100, got %d", l)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if e, expected := mapped.Get(key), fmt.Sprintf("%s=%d", key, i*2); e != expected {
+			t.Fatalf("element of %s in mapped map: expected %s, got %v", key, expected, e)
+		}
+		if e := cmap.Get(key); e != i {
+			t.Fatalf("element of %s in source: expected %d, got %v", key, i, e)
+		}
+	}
+}
+
+func Test_CMapReduce(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	number := 100000
+	for i := 1; i <= number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	sum := cmap.Reduce(0, func(acc interface{}, key string, element interface{}) interface{} {
+		return acc.(int) + element.(int)
+	})
+	if expected := number * (number + 1) / 2; sum != expected {
+		t.Fatalf("sum of elements: expected %d, got %v", expected, sum)
+	}
+	empty, _ := NewConcurrentMap(1, nil)
+	if acc := empty.Reduce("initial", nil); acc != "initial" {
+		t.Fatalf("reduce of empty map: expected initial, got %v", acc)
+	}
+}
+
+func Test_CMapSampleBucket(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	for i := 0; i < 200; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	stats := cmap.BucketStats()
+	var total int
+	for i, size := range stats {
+		pairs := cmap.SampleBucket(i)
+		if uint64(len(pairs)) != size {
+			t.Fatalf("bucket %d: sampled %d pairs, expected %d", i, len(pairs), size)
+		}
+		for _, p := range pairs {
+			if cmap.BucketIndex(p.Key()) != i {
+				t.Fatalf("pair %s sampled from bucket %d", p.Key(), i)
+			}
+		}
+		total += len(pairs)
+	}
+	if total != 200 {
+		t.Fatalf("sampled %d pairs in total, expected 200", total)
+	}
+	if cmap.SampleBucket(-1) != nil || cmap.SampleBucket(len(stats)) != nil {
+		t.Fatalf("sample bucket out of range: expected nil")
+	}
+}
+
+func Test_BucketConcurrentDoubleDelete(t *testing.T) {
+	b := newBucket()
+	cmap, _ := NewConcurrentMap(4, nil)
+	for round := 0; round < 100; round++ {
+		key := fmt.Sprintf("key-%d", round)
+		p, _ := newPair(key, round)
+		b.Put(p, nil)
+		cmap.Put(key, round)
+		var bucketDeleted, mapDeleted int32
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if b.Delete(key, nil) {
+					atomic.AddInt32(&bucketDeleted, 1)
+				}
+				if cmap.Delete(key) {
+					atomic.AddInt32(&mapDeleted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if bucketDeleted != 1 || mapDeleted != 1 {
+			t.Fatalf("round %d: %d bucket deletes and %d map deletes succeeded, expected 1",
+				round, bucketDeleted, mapDeleted)
+		}
+		if b.Size() != 0 || cmap.Len() != 0 {
+			t.Fatalf("round %d: bucket size %d, map len %d, expected 0", round, b.Size(), cmap.Len())
+		}
+	}
+}
+
+func Test_CMapKeysChan(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	seen := make(map[string]bool)
+	for key := range cmap.KeysChan(context.Background()) {
+		seen[key] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("keys received from channel: expected 100, got %d", len(seen))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := cmap.KeysChan(ctx)
+	<-keys
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range keys {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("keys channel was not closed after cancellation")
+	}
+}
+
+func Test_CMapVersion(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if _, version, ok := cmap.GetWithVersion("a"); ok || version != 0 {
+		t.Fatalf("version of absent key: expected (0, false), got (%d, %v)", version, ok)
+	}
+	if cmap.PutIfVersion("a", 1, 1) {
+		t.Fatalf("put if version 1 on absent key: expected false")
+	}
+	if !cmap.PutIfVersion("a", 1, 0) {
+		t.Fatalf("put if version 0 on absent key: expected true")
+	}
+	cmap.Put("a", 2)
+	cmap.Replace("a", 3)
+	cmap.Compute("a", func(old interface{}, exists bool) (interface{}, bool) {
+		return old.(int) + 1, false
+	})
+	element, version, ok := cmap.GetWithVersion("a")
+	if !ok || element != 4 || version != 4 {
+		t.Fatalf("get with version: expected (4, 4, true), got (%v, %d, %v)", element, version, ok)
+	}
+	if cmap.PutIfVersion("a", 5, 3) {
+		t.Fatalf("put if stale version: expected false")
+	}
+	if !cmap.PutIfVersion("a", 5, 4) || cmap.Get("a") != 5 {
+		t.Fatalf("put if current version: expected element 5")
+	}
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if _, version, _ := cmap.GetWithVersion("a"); version != 5 {
+		t.Fatalf("version after rehash: expected 5, got %d", version)
+	}
+	cmap.Delete("a")
+	cmap.Put("a", 6)
+	if _, version, _ := cmap.GetWithVersion("a"); version <= 5 {
+		t.Fatalf("version after delete and put: expected more than 5, got %d", version)
+	}
+	if cmap.PutIfVersion("a", 7, 5) {
+		t.Fatalf("put if version held before delete: expected false")
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for {
+					element, version, _ := cmap.GetWithVersion("counter")
+					n, _ := element.(int)
+					if cmap.PutIfVersion("counter", n+1, version) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if e := cmap.Get("counter"); e != 800 {
+		t.Fatalf("counter after optimistic increments: expected 800, got %v", e)
+	}
+}
+
+func Test_CMapChainLengthHistogram(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	for i := 0; i < 500; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	histogram := cmap.ChainLengthHistogram()
+	var buckets, pairs int
+	for length, count := range histogram {
+		buckets += count
+		pairs += length * count
+	}
+	if buckets != len(cmap.BucketStats()) || pairs != 500 {
+		t.Fatalf("histogram covers %d buckets and %d pairs, expected %d and 500",
+			buckets, pairs, len(cmap.BucketStats()))
+	}
+}
+
+func Test_CMapWithKeyNormalizer(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithKeyNormalizer(nil)); err == nil {
+		t.Fatalf("new concurrent map with nil key normalizer: expected error")
+	}
+	cmap, _ := NewConcurrentMap(16, nil, WithKeyNormalizer(strings.ToLower))
+	if isNew, _ := cmap.Put("Foo", 1); !isNew {
+		t.Fatalf("put Foo: expected isNew=true")
+	}
+	if e := cmap.Get("foo"); e != 1 {
+		t.Fatalf("get foo: expected 1, got %v", e)
+	}
+	if !cmap.Contains("FOO") {
+		t.Fatalf("contains FOO: expected true")
+	}
+	if isNew, _ := cmap.Put("fOO", 2); isNew || cmap.Len() != 1 {
+		t.Fatalf("put fOO: expected overwrite, len %d", cmap.Len())
+	}
+	cmap.Put("Bar", 3)
+	cmap.Replace("BAR", 4)
+	keys := cmap.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"Bar", "fOO"}) {
+		t.Fatalf("keys: expected original keys [Bar fOO], got %v", keys)
+	}
+	if e := cmap.Snapshot().Get("bar"); e != 4 {
+		t.Fatalf("snapshot get bar: expected 4, got %v", e)
+	}
+	if !cmap.Delete("FOO") || cmap.Contains("foo") || cmap.Len() != 1 {
+		t.Fatalf("delete FOO: expected foo to be removed")
+	}
+}
+
+func Test_CMapWithInsertionOrder(t *testing.T) {
+	for _, refresh := range []bool{false, true} {
+		cmap, _ := NewConcurrentMap(16, nil, WithInsertionOrder(refresh), WithMaxSize(100))
+		for i := 0; i < 50; i++ {
+			cmap.Put(fmt.Sprintf("k%d", i), i)
+		}
+		cmap.Delete("k10")
+		cmap.Put("k0", -1)
+		var expected []string
+		for i := 1; i < 50; i++ {
+			if i != 10 {
+				expected = append(expected, fmt.Sprintf("k%d", i))
+			}
+		}
+		if refresh {
+			expected = append(expected, "k0")
+		} else {
+			expected = append([]string{"k0"}, expected...)
+		}
+		if keys := cmap.Keys(); !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("keys with refresh=%v: expected %v, got %v", refresh, expected, keys)
+		}
+	}
+}
+
+func Test_CMapGetAll(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithClock(clock.Now))
+	defer cmap.Close()
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	cmap.PutWithTTL("expired", 1, time.Nanosecond)
+	clock.Advance(time.Millisecond)
+	keys := []string{"k1", "absent", "k50", "expired", "k99"}
+	found, missing := cmap.GetAllWithMissing(keys)
+	expected := map[string]interface{}{"k1": 1, "k50": 50, "k99": 99}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("found: expected %v, got %v", expected, found)
+	}
+	if !reflect.DeepEqual(missing, []string{"absent", "expired"}) {
+		t.Fatalf("missing: expected [absent expired], got %v", missing)
+	}
+	if all := cmap.GetAll(keys); !reflect.DeepEqual(all, expected) {
+		t.Fatalf("get all: expected %v, got %v", expected, all)
+	}
+	cmap.Close()
+}
+
+func Test_CMapApproxMemoryBytes(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil)
+	empty := cmap.ApproxMemoryBytes()
+	if empty == 0 {
+		t.Fatalf("approx memory of empty map: expected bucket overhead")
+	}
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("key-%04d", i), i)
+	}
+	full := cmap.ApproxMemoryBytes()
+	if min := empty + 1000*(pairOverheadBytes+8); full < min {
+		t.Fatalf("approx memory of 1000 pairs: expected at least %d, got %d", min, full)
+	}
+	cmap.Clear()
+	cmap.Compact()
+	if shrunk := cmap.ApproxMemoryBytes(); shrunk >= full {
+		t.Fatalf("approx memory after clear: expected less than %d, got %d", full, shrunk)
+	}
+}
+
+func Test_CMapWithIncrementalResize(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithIncrementalResize(0)); err == nil {
+		t.Fatalf("new concurrent map with zero incremental resize step: expected error")
+	}
+	cmap, _ := NewConcurrentMap(1, nil, WithInitialBuckets(64), WithIncrementalResize(1))
+	s := cmap.(*myConcurrentMap).segments[0].(*segment)
+	var i int
+	for ; s.oldBuckets == nil; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if s.unmigrated < len(s.oldBuckets)-2 {
+		t.Fatalf("resize migrated %d of %d buckets at once", len(s.oldBuckets)-s.unmigrated, len(s.oldBuckets))
+	}
+	for j := 0; j < i; j++ {
+		if e := cmap.Get(fmt.Sprintf("k%d", j)); e != j {
+			t.Fatalf("element of k%d during migration: expected %d, got %v", j, j, e)
+		}
+	}
+	if snap := cmap.Snapshot(); snap.Get("k0") != 0 || snap.Len() != uint64(i) {
+		t.Fatalf("snapshot during migration: unexpected content")
+	}
+	if len(cmap.Keys()) != i || cmap.BucketIndex("k0") >= len(cmap.BucketStats()) {
+		t.Fatalf("iteration during migration: unexpected content")
+	}
+
+	number := 20000
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for j := i + w; j < number; j += 4 {
+				cmap.Put(fmt.Sprintf("k%d", j), j)
+				if e := cmap.Get(fmt.Sprintf("k%d", j-4)); j-4 >= 0 && e != j-4 {
+					t.Errorf("element of k%d: expected %d, got %v", j-4, j-4, e)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for j := 0; j < number; j += 2 {
+		cmap.Delete(fmt.Sprintf("k%d", j))
+	}
+	cmap.Compact()
+	if s.oldBuckets != nil {
+		t.Fatalf("compact did not finish the migration")
+	}
+	if cmap.Len() != uint64(number/2) || len(cmap.Keys()) != number/2 {
+		t.Fatalf("len after deletes: expected %d, got %d with %d keys", number/2, cmap.Len(), len(cmap.Keys()))
+	}
+	for j := 1; j < number; j += 2 {
+		if e := cmap.Get(fmt.Sprintf("k%d", j)); e != j {
+			t.Fatalf("element of k%d: expected %d, got %v", j, j, e)
+		}
+	}
+}
+
+func Test_CMapDrainAll(t *testing.T) {
+	var evicted int32
+	cmap, _ := NewConcurrentMap(16, nil, WithEvictionCallback(func(key string, element interface{}) {
+		atomic.AddInt32(&evicted, 1)
+	}))
+	var wg sync.WaitGroup
+	var written int32
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cmap.Put(fmt.Sprintf("k%d", i), i)
+			atomic.AddInt32(&written, 1)
+		}
+	}()
+	seen := make(map[string]bool)
+	for round := 0; round < 20; round++ {
+		for key := range cmap.DrainAll() {
+			if seen[key] {
+				t.Fatalf("key %s drained twice", key)
+			}
+			seen[key] = true
+		}
+	}
+	close(stop)
+	wg.Wait()
+	for key := range cmap.DrainAll() {
+		seen[key] = true
+	}
+	if len(seen) != int(written) || cmap.Len() != 0 {
+		t.Fatalf("drained %d keys of %d written, len %d", len(seen), written, cmap.Len())
+	}
+	if evicted != written {
+		t.Fatalf("eviction callbacks: expected %d, got %d", written, evicted)
+	}
+}
+
+func Test_CMapRangeSafe(t *testing.T) {
+	cmap, _ := NewConcurrentMap(4, nil, WithPairPool())
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	err := cmap.RangeSafe(func(key string, element interface{}) bool {
+		panic("boom")
+	})
+	var cpe CallbackPanicError
+	if !errors.Is(err, ErrCallbackPanic) || !errors.As(err, &cpe) || cpe.Value() != "boom" {
+		t.Fatalf("range safe: expected callback panic error, got %v", err)
+	}
+	if err := cmap.RangeSafe(func(key string, element interface{}) bool { return true }); err != nil {
+		t.Fatalf("range safe without panic: %s", err)
+	}
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expected panic", name)
+			}
+		}()
+		f()
+	}
+	mustPanic("range context", func() {
+		cmap.RangeContext(context.Background(), func(key string, element interface{}) bool { panic("boom") })
+	})
+	mustPanic("update", func() {
+		cmap.Update([]string{"k1", "k2"}, func(map[string]interface{}) map[string]interface{} { panic("boom") })
+	})
+	mustPanic("compute", func() {
+		cmap.Compute("k1", func(interface{}, bool) (interface{}, bool) { panic("boom") })
+	})
+	mustPanic("drain", func() {
+		cmap.Drain(func(key string, element interface{}) bool { panic("boom") })
+	})
+	for _, s := range cmap.(*myConcurrentMap).segments {
+		if readers := atomic.LoadInt64(&s.(*segment).readers); readers != 0 {
+			t.Fatalf("readers after panics: expected 0, got %d", readers)
+		}
+	}
+	cmap.Put("after", 1)
+	if cmap.Get("after") != 1 || !cmap.Delete("after") || len(cmap.DrainAll()) == 0 {
+		t.Fatalf("operations after panics did not work")
+	}
+}
+
+func Test_CMapIncrement(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if _, err := cmap.Increment("counter", 1); err != nil {
+					t.Errorf("increment: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if e := cmap.Get("counter"); e != int64(8000) {
+		t.Fatalf("counter after increments: expected 8000, got %v", e)
+	}
+	if n, err := cmap.Increment("counter", -8001); err != nil || n != -1 {
+		t.Fatalf("increment by -8001: expected -1, got %d (%v)", n, err)
+	}
+	cmap.Put("text", "1")
+	if _, err := cmap.Increment("text", 1); !errors.Is(err, ErrUnexpectedElementType) || !errors.Is(err, ErrIllegalParameter) {
+		t.Fatalf("increment string element: expected unexpected element type error, got %v", err)
+	}
+	if e := cmap.Get("text"); e != "1" {
+		t.Fatalf("element after failed increment: expected 1, got %v", e)
+	}
+}
+
+func Test_CMapAppend(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := cmap.Append("list", w, i); err != nil {
+					t.Errorf("append: %s", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	before := cmap.Get("list").([]interface{})
+	if len(before) != 800 {
+		t.Fatalf("len of list: expected 800, got %d", len(before))
+	}
+	cmap.Append("list", "tail")
+	if len(before) != 800 || len(cmap.Get("list").([]interface{})) != 801 {
+		t.Fatalf("append changed a previously read slice")
+	}
+	cmap.Put("text", "a")
+	if err := cmap.Append("text", "b"); !errors.Is(err, ErrUnexpectedElementType) {
+		t.Fatalf("append to string element: expected unexpected element type error, got %v", err)
+	}
+}
+
+func Test_CMapReadOnly(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	view := cmap.ReadOnly()
+	if _, ok := view.(ConcurrentMap); ok {
+		t.Fatalf("read-only view can be asserted to ConcurrentMap")
+	}
+	cmap.Put("b", 2)
+	if e, ok := view.Load("b"); !ok || e != 2 || view.Len() != 2 || !view.Contains("a") {
+		t.Fatalf("read-only view does not reflect later writes")
+	}
+	keys := view.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) || len(view.Values()) != 2 {
+		t.Fatalf("keys of read-only view: expected [a b], got %v", keys)
+	}
+	var n int
+	view.Range(func(key string, element interface{}) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Fatalf("range over read-only view: expected 2 pairs, got %d", n)
+	}
+}
+
+func Test_CMapWithKeyEquals(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithKeyEquals(nil)); err == nil {
+		t.Fatalf("new concurrent map with nil key equals: expected error")
+	}
+	// 比较时忽略首尾空白，散列函数也必须忽略它们
+	equals := func(a, b string) bool {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	hashFunc := func(key string) uint64 {
+		return hash(strings.TrimSpace(key))
+	}
+	cmap, _ := NewConcurrentMap(16, nil, WithKeyEquals(equals), WithHashFunc(hashFunc))
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("key-%d", i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if e := cmap.Get(fmt.Sprintf("  key-%d\t", i)); e != i {
+			t.Fatalf("element of padded key-%d: expected %d, got %v", i, i, e)
+		}
+	}
+	if isNew, _ := cmap.Put(" key-0 ", -1); isNew || cmap.Len() != 1000 {
+		t.Fatalf("put padded key-0: expected overwrite, len %d", cmap.Len())
+	}
+	if e := cmap.Snapshot().Get("key-0  "); e != -1 {
+		t.Fatalf("snapshot get padded key-0: expected -1, got %v", e)
+	}
+	if !cmap.Delete("\tkey-1") || cmap.Contains("key-1") {
+		t.Fatalf("delete padded key-1: expected key-1 to be removed")
+	}
+}
+
+func Test_CMapWriteCSV(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	cmap.Put("with,comma", `say "hi"`)
+	var buf bytes.Buffer
+	if err := cmap.WriteCSV(&buf); err != nil {
+		t.Fatalf("write csv: %s", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %s", err)
+	}
+	if len(records) != 3 || !reflect.DeepEqual(records[0], []string{"key", "value"}) {
+		t.Fatalf("csv records: unexpected %v", records)
+	}
+	rows := map[string]string{records[1][0]: records[1][1], records[2][0]: records[2][1]}
+	if !reflect.DeepEqual(rows, map[string]string{"a": "1", "with,comma": `say "hi"`}) {
+		t.Fatalf("csv rows: unexpected %v", rows)
+	}
+}
+
+func Test_CMapComputeWithRetry(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	if _, err := cmap.ComputeWithRetry("counter", -1, nil); !errors.Is(err, ErrIllegalParameter) {
+		t.Fatalf("compute with negative retries: expected illegal parameter error, got %v", err)
+	}
+	increment := func(old interface{}, exists bool) interface{} {
+		n, _ := old.(int)
+		return n + 1
+	}
+	var wg sync.WaitGroup
+	var failed int32
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := cmap.ComputeWithRetry("counter", 1000, increment); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if e := cmap.Get("counter"); failed != 0 || e != 800 {
+		t.Fatalf("counter after retried increments: expected 800, got %v with %d failures", e, failed)
+	}
+
+	// 每次调用f时都修改键，使版本号总是冲突
+	attempts := 0
+	_, err := cmap.ComputeWithRetry("hot", 2, func(old interface{}, exists bool) interface{} {
+		attempts++
+		cmap.Put("hot", attempts)
+		return -1
+	})
+	if !errors.Is(err, ErrRetriesExhausted) || attempts != 3 {
+		t.Fatalf("compute with conflicts: expected retries exhausted after 3 attempts, got %v after %d", err, attempts)
+	}
+}
+
+func Test_CMapFindKey(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if key, found := cmap.FindKey(func(element interface{}) bool { return element == 42 }); !found || key != "k42" {
+		t.Fatalf("find key of 42: expected k42, got %q (%v)", key, found)
+	}
+	if key, found := cmap.FindKey(func(element interface{}) bool { return element == -1 }); found || key != "" {
+		t.Fatalf("find key of -1: expected not found, got %q", key)
+	}
+}
+
+func Test_CMapWithValueCopier(t *testing.T) {
+	if _, err := NewConcurrentMap(1, nil, WithValueCopier(nil)); err == nil {
+		t.Fatalf("new concurrent map with nil value copier: expected error")
+	}
+	type account struct {
+		balance int
+	}
+	copier := func(element interface{}) interface{} {
+		if a, ok := element.(*account); ok {
+			c := *a
+			return &c
+		}
+		return element
+	}
+	cmap, _ := NewConcurrentMap(16, nil, WithValueCopier(copier))
+	original := &account{balance: 100}
+	cmap.Put("a", original)
+	original.balance = 0
+	loaded := cmap.Get("a").(*account)
+	if loaded.balance != 100 {
+		t.Fatalf("balance after mutating the put value: expected 100, got %d", loaded.balance)
+	}
+	loaded.balance = 1
+	if e := cmap.Get("a").(*account); e.balance != 100 || e == loaded {
+		t.Fatalf("balance after mutating the loaded value: expected 100, got %d", e.balance)
+	}
+	replacement := &account{balance: 200}
+	cmap.Replace("a", replacement)
+	replacement.balance = 0
+	if e, _, _ := cmap.GetWithVersion("a"); e.(*account).balance != 200 {
+		t.Fatalf("balance after mutating the replacement: expected 200, got %d", e.(*account).balance)
+	}
+}
+
+func Test_CMapDeleteWhere(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for i := 0; i < 1000; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	deleted := cmap.DeleteWhere(func(key string, element interface{}) bool {
+		return element.(int) < 300
+	})
+	if deleted != 300 || cmap.Len() != 700 {
+		t.Fatalf("delete where element < 300: deleted %d, len %d", deleted, cmap.Len())
+	}
+	if cmap.Contains("k299") || !cmap.Contains("k300") {
+		t.Fatalf("delete where removed the wrong keys")
+	}
+	if n := cmap.DeleteWhere(func(string, interface{}) bool { return false }); n != 0 || cmap.Len() != 700 {
+		t.Fatalf("delete where nothing matches: deleted %d, len %d", n, cmap.Len())
+	}
+}
+
+func Test_CMapSecondaryIndex(t *testing.T) {
+	type user struct{ city string }
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("alice", user{"paris"})
+	byCity := func(element interface{}) string { return element.(user).city }
+	if err := cmap.AddIndex("city", byCity); err != nil {
+		t.Fatalf("add index error: %s", err)
+	}
+	if err := cmap.AddIndex("city", byCity); err == nil {
+		t.Fatalf("add duplicate index: expected an error")
+	}
+	cmap.Put("bob", user{"paris"})
+	cmap.Put("carol", user{"rome"})
+	if keys := cmap.QueryIndex("city", "paris"); !reflect.DeepEqual(keys, []string{"alice", "bob"}) {
+		t.Fatalf("query paris: expected [alice bob], got %v", keys)
+	}
+	cmap.Put("bob", user{"rome"})
+	cmap.Delete("carol")
+	if keys := cmap.QueryIndex("city", "paris"); !reflect.DeepEqual(keys, []string{"alice"}) {
+		t.Fatalf("query paris after moving bob: expected [alice], got %v", keys)
+	}
+	if keys := cmap.QueryIndex("city", "rome"); !reflect.DeepEqual(keys, []string{"bob"}) {
+		t.Fatalf("query rome: expected [bob], got %v", keys)
+	}
+	if keys := cmap.QueryIndex("country", "fr"); keys != nil {
+		t.Fatalf("query unknown index: expected nil, got %v", keys)
+	}
+}
+
+func Test_CMapWithCapacityFIFO(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithCapacityFIFO(0)); err == nil {
+		t.Fatalf("zero fifo capacity: expected error")
+	}
+	cmap, _ := NewConcurrentMap(16, nil, WithCapacityFIFO(3))
+	cmap.Put("a", 1)
+	cmap.Put("b", 2)
+	cmap.Put("c", 3)
+	cmap.Get("a")
+	cmap.Put("a", 10)
+	cmap.Put("d", 4)
+	if cmap.Contains("a") {
+		t.Fatalf("oldest inserted key a was not evicted")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if !cmap.Contains(key) {
+			t.Fatalf("key %s was evicted unexpectedly", key)
+		}
+	}
+	cmap.Delete("c")
+	cmap.Put("e", 5)
+	cmap.Put("f", 6)
+	if cmap.Contains("b") || cmap.Len() != 3 {
+		t.Fatalf("key b should be evicted: keys=%v", cmap.Keys())
+	}
+}
+
+func Test_CMapCountByPrefix(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	for _, key := range []string{"user:1", "user:2", "order:1", "user:3:x", "plain"} {
+		cmap.Put(key, true)
+	}
+	expected := map[string]int{"user": 3, "order": 1, "plain": 1}
+	if counts := cmap.CountByPrefix(":"); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("count by prefix: expected %v, got %v", expected, counts)
+	}
+}
+
+func Test_CMapRename(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	cmap.Put("b", 2)
+	if ok, err := cmap.Rename("missing", "c", false); ok || err != nil {
+		t.Fatalf("rename missing key: expected false, got %v, %v", ok, err)
+	}
+	if ok, _ := cmap.Rename("a", "b", false); ok || cmap.Get("a") != 1 || cmap.Get("b") != 2 {
+		t.Fatalf("rename onto an existing key without overwrite changed the map")
+	}
+	if ok, _ := cmap.Rename("a", "c", false); !ok || cmap.Contains("a") || cmap.Get("c") != 1 || cmap.Len() != 2 {
+		t.Fatalf("rename a to c: ok=%v, len %d", ok, cmap.Len())
+	}
+	if ok, _ := cmap.Rename("c", "b", true); !ok || cmap.Contains("c") || cmap.Get("b") != 1 || cmap.Len() != 1 {
+		t.Fatalf("rename c onto b with overwrite: ok=%v, len %d", ok, cmap.Len())
+	}
+	if ok, _ := cmap.Rename("b", "b", true); !ok || cmap.Get("b") != 1 || cmap.Len() != 1 {
+		t.Fatalf("rename b onto itself: ok=%v, len %d", ok, cmap.Len())
+	}
+	if err := cmap.CheckInvariants(); err != nil {
+		t.Fatalf("invariants after renames: %s", err)
+	}
+}
+
+func Test_CMapGetOrCompute(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]interface{}, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cmap.GetOrCompute("k", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return 42, nil
+			})
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("compute calls: expected 1, got %d", calls)
+	}
+	for i, r := range results {
+		if r != 42 {
+			t.Fatalf("result %d: expected 42, got %v", i, r)
+		}
+	}
+	computeErr := errors.New("boom")
+	if _, err := cmap.GetOrCompute("bad", func() (interface{}, error) { return nil, computeErr }); err != computeErr {
+		t.Fatalf("compute error: expected %v, got %v", computeErr, err)
+	}
+	if cmap.Contains("bad") || cmap.Len() != 1 {
+		t.Fatalf("failed compute stored a value")
+	}
+}
+
+func FuzzCMapInvariants(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Add([]byte{1, 1, 1, 65, 65, 129, 129, 193, 193, 0, 2, 66})
+	// 第0个协程先放入k0，再把它重命名为自己
+	f.Add([]byte{0, 1, 1, 1, 192, 0, 1, 1})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		cmap, _ := NewConcurrentMap(4, nil, WithInitialBuckets(1), WithIncrementalResize(1))
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(ops); i += 4 {
+					key := fmt.Sprintf("k%d", ops[i]&63)
+					switch ops[i] >> 6 {
+					case 0:
+						cmap.Put(key, i)
+					case 1:
+						cmap.Delete(key)
+					case 2:
+						cmap.Compute(key, func(old interface{}, exists bool) (interface{}, bool) {
+							return i, exists
+						})
+					case 3:
+						cmap.Rename(key, fmt.Sprintf("k%d", (ops[i]+ops[(i+1)%len(ops)])&63), true)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		if err := cmap.CheckInvariants(); err != nil {
+			t.Fatalf("invariants after %d operations: %s", len(ops), err)
+		}
+	})
+}
+
+func Test_CMapNewPair(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	pairs := []Pair{NewPair("a", 1), NewPair("b", 2), NewPair("", 3)}
+	if inserted, err := cmap.BatchPut(pairs); inserted != 3 || err != nil {
+		t.Fatalf("batch put exported pairs: inserted %d, err %v", inserted, err)
+	}
+	if cmap.Get("b") != 2 || cmap.Get("") != 3 {
+		t.Fatalf("batch put exported pairs: unexpected elements %v", cmap.Keys())
+	}
+}
+
+func Test_CMapWithMoveToFrontOnGet(t *testing.T) {
+	cmap, _ := NewConcurrentMap(1, nil, WithInitialBuckets(1), WithLoadFactor(100), WithMoveToFrontOnGet())
+	for i := 0; i < 5; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	if head := cmap.SampleBucket(0)[0].Key(); head != "k4" {
+		t.Fatalf("chain head before get: expected k4, got %s", head)
+	}
+	if cmap.Get("k0") != 0 {
+		t.Fatalf("get k0: unexpected element")
+	}
+	chain := cmap.SampleBucket(0)
+	if len(chain) != 5 || chain[0].Key() != "k0" {
+		t.Fatalf("chain after get k0: expected k0 at the head of 5 pairs, got %v", chain)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("k%d", (i+w)%8)
+				if w%2 == 0 {
+					cmap.Get(key)
+				} else {
+					cmap.Put(key, i)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := cmap.CheckInvariants(); err != nil {
+		t.Fatalf("invariants after concurrent gets and puts: %s", err)
+	}
+}
+
+func Test_CMapMoveToFrontMaxDepth(t *testing.T) {
+	cmap, _ := NewConcurrentMap(1, nil, WithInitialBuckets(1), WithLoadFactor(100), WithMoveToFrontOnGet())
+	number := MOVE_TO_FRONT_MAX_DEPTH + 2
+	for i := 0; i < number; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	// k0位于最深处，超出了移动的限制
+	cmap.Get("k0")
+	if head := cmap.SampleBucket(0)[0].Key(); head != fmt.Sprintf("k%d", number-1) {
+		t.Fatalf("chain head after get of a deep pair: expected it to stay in place, got %s at the head", head)
+	}
+	limit := fmt.Sprintf("k%d", number-1-MOVE_TO_FRONT_MAX_DEPTH)
+	cmap.Get(limit)
+	if head := cmap.SampleBucket(0)[0].Key(); head != limit {
+		t.Fatalf("chain head after get of the pair at the depth limit: expected %s, got %s", limit, head)
+	}
+}
+
+func Test_CMapMoveToFrontWithRefreshOnGet(t *testing.T) {
+	cmap, _ := NewConcurrentMap(1, nil, WithInitialBuckets(1), WithLoadFactor(100),
+		WithMoveToFrontOnGet(), WithRefreshOnGet(true))
+	defer cmap.Close()
+	cmap.PutWithTTL("hot", 1, time.Hour)
+	for i := 0; i < 3; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	// 把过期时间提前，以便判断读取之后留在链表中的键-元素对是否被刷新
+	soon := time.Now().Add(time.Minute).UnixNano()
+	m := cmap.(*myConcurrentMap)
+	keyHash := m.opts.hashFunc("hot")
+	s := m.findSegment(keyHash)
+	s.Lock()
+	s.GetLocked("hot", keyHash).SetExpiration(soon)
+	s.Unlock()
+	if cmap.Get("hot") != 1 {
+		t.Fatalf("get hot: unexpected element")
+	}
+	head := cmap.SampleBucket(0)[0]
+	if head.Key() != "hot" {
+		t.Fatalf("chain head after get: expected hot, got %s", head.Key())
+	}
+	if head.Expiration() <= soon {
+		t.Fatalf("expiration of the moved pair: expected it to be refreshed")
+	}
+	if remaining, _ := cmap.TTLRemaining("hot"); remaining < 30*time.Minute {
+		t.Fatalf("ttl remaining after get: expected about an hour, got %s", remaining)
+	}
+}
+
+type latencyObserver struct {
+	countingObserver
+	samples int64
+}
+
+func (o *latencyObserver) OnGetLatency(d time.Duration) {
+	atomic.AddInt64(&o.samples, 1)
+}
+
+func Test_CMapWithLatencySampling(t *testing.T) {
+	if _, err := NewConcurrentMap(16, nil, WithLatencySampling(0)); err == nil {
+		t.Fatalf("zero sampling rate: expected error")
+	}
+	observer := &latencyObserver{}
+	cmap, _ := NewConcurrentMap(16, nil, WithObserver(observer), WithLatencySampling(0.1))
+	cmap.Put("a", 1)
+	for i := 0; i < 10000; i++ {
+		cmap.Get("a")
+	}
+	if samples := atomic.LoadInt64(&observer.samples); samples < 900 || samples > 1100 {
+		t.Fatalf("latency samples at rate 0.1: expected about 1000, got %d", samples)
+	}
+	if hits := atomic.LoadInt64(&observer.hits); hits != 10000 {
+		t.Fatalf("hits with latency sampling: expected 10000, got %d", hits)
+	}
+}
+
+func Test_CMapWaitFor(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("ready", 1)
+	if e, err := cmap.WaitFor(context.Background(), "ready"); e != 1 || err != nil {
+		t.Fatalf("wait for existing key: got %v, %v", e, err)
+	}
+	result := make(chan interface{})
+	go func() {
+		e, _ := cmap.WaitFor(context.Background(), "later")
+		result <- e
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cmap.Put("later", 2)
+	if e := <-result; e != 2 {
+		t.Fatalf("wait for later key: expected 2, got %v", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cmap.WaitFor(ctx, "never"); err != context.DeadlineExceeded {
+		t.Fatalf("wait for missing key: expected deadline exceeded, got %v", err)
+	}
+	if n := len(cmap.(*myConcurrentMap).waiters.waiters); n != 0 {
+		t.Fatalf("waiters left after cancellation: %d", n)
+	}
+}
+
+func Test_CMapTransaction(t *testing.T) {
+	cmap, _ := NewConcurrentMap(16, nil)
+	cmap.Put("a", 1)
+	cmap.Put("b", 2)
+	err := cmap.Transaction(func(tx Tx) error {
+		a, _ := tx.Get("a")
+		tx.Put("c", a.(int)+10)
+		tx.Delete("a")
+		if _, ok := tx.Get("a"); ok {
+			t.Fatalf("tx get after tx delete: expected missing")
+		}
+		if !cmap.Contains("a") || cmap.Contains("c") {
+			t.Fatalf("writes were applied before commit")
+		}
+		return nil
+	})
+	if err != nil || cmap.Contains("a") || cmap.Get("c") != 11 || cmap.Len() != 2 {
+		t.Fatalf("committed transaction: err %v, keys %v, len %d", err, cmap.Keys(), cmap.Len())
+	}
+	abort := errors.New("abort")
+	err = cmap.Transaction(func(tx Tx) error {
+		tx.Put("d", 4)
+		tx.Delete("b")
+		return abort
+	})
+	if err != abort || cmap.Contains("d") || !cmap.Contains("b") || cmap.Len() != 2 {
+		t.Fatalf("aborted transaction: err %v, keys %v", err, cmap.Keys())
+	}
+}
+
+func Test_BucketEmptyHead(t *testing.T) {
+	b := newBucket()
+	if b.GetFirstPair() != nil || len(b.Pairs()) != 0 {
+		t.Fatalf("new bucket is not empty")
+	}
+	for i := 0; i < 3; i++ {
+		p, _ := newPair(fmt.Sprintf("k%d", i), i)
+		b.Put(p, nil)
+	}
+	b.Delete("k1", nil)
+	b.Delete("k2", nil)
+	b.Delete("k0", nil)
+	if b.GetFirstPair() != nil || b.Size() != 0 {
+		t.Fatalf("bucket after deleting every key: head %v, size %d", b.GetFirstPair(), b.Size())
+	}
+	cmap, _ := NewConcurrentMap(2, nil, WithInitialBuckets(1))
+	for i := 0; i < 100; i++ {
+		cmap.Put(fmt.Sprintf("k%d", i), i)
+	}
+	for i := 0; i < 100; i += 2 {
+		cmap.Delete(fmt.Sprintf("k%d", i))
+	}
+	if err := cmap.CheckInvariants(); err != nil {
+		t.Fatalf("invariants after deletes: %s", err)
+	}
+	cmap.Clear()
+	if err := cmap.CheckInvariants(); err != nil || cmap.Len() != 0 {
+		t.Fatalf("invariants after clear: %v, len %d", err, cmap.Len())
+	}
+}
+
+func Test_CMapTTLRemaining(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithClock(clock.Now))
+	defer cmap.Close()
+	cmap.Put("forever", 1)
+	cmap.PutWithTTL("soon", 2, time.Hour)
+	if d, ok := cmap.TTLRemaining("forever"); !ok || d != TTL_NO_EXPIRY {
+		t.Fatalf("ttl remaining without ttl: got %v, %v", d, ok)
+	}
+	if d, ok := cmap.TTLRemaining("soon"); !ok || d != time.Hour {
+		t.Fatalf("ttl remaining with one hour ttl: got %v, %v", d, ok)
+	}
+	clock.Advance(time.Minute)
+	if d, ok := cmap.TTLRemaining("soon"); !ok || d != 59*time.Minute {
+		t.Fatalf("ttl remaining after one minute: got %v, %v", d, ok)
+	}
+	clock.Advance(59 * time.Minute)
+	if _, ok := cmap.TTLRemaining("soon"); ok {
+		t.Fatalf("ttl remaining after expiry: expected false")
+	}
+	if _, ok := cmap.TTLRemaining("missing"); ok {
+		t.Fatalf("ttl remaining of missing key: expected false")
+	}
+}
+
+func Test_CMapPutIfAbsentAndGetOrPutAfterExpiry(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithClock(clock.Now))
+	defer cmap.Close()
+	cmap.PutWithTTL("a", 1, 10*time.Millisecond)
+	cmap.PutWithTTL("b", 1, 10*time.Millisecond)
+	if ok, _ := cmap.PutIfAbsent("a", 0); ok {
+		t.Fatalf("put if absent before expiry: expected false")
+	}
+	clock.Advance(10 * time.Millisecond)
+	if ok, err := cmap.PutIfAbsent("a", 2); !ok || err != nil || cmap.Get("a") != 2 {
+		t.Fatalf("put if absent after expiry: ok=%v, err %v, element %v", ok, err, cmap.Get("a"))
+	}
+	if actual, loaded := cmap.GetOrPut("b", func() interface{} { return 3 }); loaded || actual != 3 || cmap.Get("b") != 3 {
+		t.Fatalf("get or put after expiry: actual %v, loaded %v", actual, loaded)
+	}
+	if cmap.Len() != 2 {
+		t.Fatalf("len after replacing expired pairs: expected 2, got %d", cmap.Len())
+	}
+	if err := cmap.CheckInvariants(); err != nil {
+		t.Fatalf("invariants after replacing expired pairs: %s", err)
+	}
+}
+
+func Test_CMapRefreshOnGetAfterReplace(t *testing.T) {
+	clock := newFakeClock()
+	cmap, _ := NewConcurrentMap(16, nil, WithRefreshOnGet(true), WithClock(clock.Now))
+	defer cmap.Close()
+	ttl := 40 * time.Millisecond
+	cmap.PutWithTTL("replaced", 1, ttl)
+	cmap.PutWithTTL("computed", 1, ttl)
+	cmap.Replace("replaced", 2)
+	cmap.Compute("computed", func(old interface{}, exists bool) (interface{}, bool) {
+		return 2, false
+	})
+	for i := 0; i < 12; i++ {
+		cmap.Get("replaced")
+		cmap.Get("computed")
+		clock.Advance(ttl / 4)
+	}
+	for _, key := range []string{"replaced", "computed"} {
+		if e := cmap.Get(key); e != 2 {
+			t.Fatalf("element of %s key refreshed by gets: expected 2, got %v", key, e)
+		}
+	}
+}
+
+func Test_CMapStatsBulkOperations(t *testing.T) {
+	observer := &countingObserver{}
+	cmap, _ := NewConcurrentMap(16, nil, WithObserver(observer))
+	cmap.PutIfAbsent("a", 1)
+	cmap.PutIfAbsent("a", 2)
+	if stats := cmap.Stats(); stats.Puts != 1 || observer.puts != 1 {
+		t.Fatalf("rejected put if absent: puts %d, observed %d", stats.Puts, observer.puts)
+	}
+	cmap.PutAll(map[string]interface{}{"a": 3, "b": 1, "c": 1, "d": 1})
+	if stats := cmap.Stats(); stats.Puts != 5 || observer.inserts != 4 {
+		t.Fatalf("put all: puts %d, observed inserts %d", stats.Puts, observer.inserts)
+	}
+	cmap.BatchDelete([]string{"a", "missing"})
+	cmap.DeleteWhere(func(key string, element interface{}) bool { return key == "b" })
+	cmap.Clear()
+	if stats := cmap.Stats(); stats.Deletes != 5 || observer.found != 4 || observer.notFound != 1 {
+		t.Fatalf("bulk deletes: deletes %d, observed found %d, not found %d", stats.Deletes, observer.found, observer.notFound)
+	}
+}
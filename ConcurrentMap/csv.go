@@ -0,0 +1,24 @@
+package concurrentMap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+func (cmap *myConcurrentMap) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "value"}); err != nil {
+		return err
+	}
+	var err error
+	cmap.Snapshot().Range(func(key string, element interface{}) bool {
+		err = cw.Write([]string{key, fmt.Sprintf("%v", element)})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -1,10 +1,49 @@
 package concurrentMap
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// 可以用errors.Is判断的错误，具体的错误类型会包装它们。
+var (
+	// ErrIllegalParameter 代表参数非法，所有IllegalParameterError都满足它
+	ErrIllegalParameter = errors.New("concurrent map: illegal parameter")
+	// ErrNilPair 代表键-元素对为nil
+	ErrNilPair = errors.New("pair is nil")
+	// ErrNilElement 代表元素为nil。
+	//
+	// Deprecated: 元素可以为nil，字典不再返回这个错误，保留它只是为了兼容。
+	ErrNilElement = errors.New("element is nil")
+	// ErrNilHashFunc 代表散列函数为nil
+	ErrNilHashFunc = errors.New("hash function is nil")
+	// ErrInvalidBucketCount 代表散列桶数量不是正数
+	ErrInvalidBucketCount = errors.New("bucket number is not positive")
+	// ErrInvalidConcurrency 代表并发量超出了允许的范围
+	ErrInvalidConcurrency = errors.New("concurrency is out of range")
+	// ErrInvalidTTL 代表ttl不是正数
+	ErrInvalidTTL = errors.New("ttl is not positive")
+	// ErrIllegalPairType 代表键-元素对的类型非法，所有IllegalPairTypeError都满足它
+	ErrIllegalPairType = errors.New("concurrent map: illegal pair type")
+	// ErrPairRedistribution 代表无法再分布键-元素对，所有PairRedistributorError都满足它
+	ErrPairRedistribution = errors.New("concurrent map: failing pair redistribution")
+	// ErrCorruptRecord 代表记录不完整或已损坏，所有CorruptRecordError都满足它
+	ErrCorruptRecord = errors.New("concurrent map: corrupt record")
+	// ErrUnexpectedElementType 代表已有元素的类型不是操作所要求的类型
+	ErrUnexpectedElementType = errors.New("element has unexpected type")
+	// ErrRetriesExhausted 代表乐观更新在允许的重试次数内始终遇到冲突，所有RetriesExhaustedError都满足它
+	ErrRetriesExhausted = errors.New("concurrent map: retries exhausted")
+	// ErrCallbackPanic 代表调用方给出的回调函数引发了panic，所有CallbackPanicError都满足它
+	ErrCallbackPanic = errors.New("concurrent map: callback panicked")
+	// ErrInvariantViolated 代表字典的内部状态不一致，所有InvariantError都满足它
+	ErrInvariantViolated = errors.New("concurrent map: invariant violated")
+)
 
 // IllegalParameterError 代表非法的参数的错误类型。
 type IllegalParameterError struct {
 	msg string
+	// 具体的原因，可以为nil
+	cause error
 }
 
 // newIllegalParameterError 会创建一个IllegalParameterError类型的实例。
@@ -14,10 +53,25 @@ func newIllegalParameterError(errMsg string) IllegalParameterError {
 	}
 }
 
+// newIllegalParameterErrorWithCause 会创建一个以cause为具体原因的IllegalParameterError类型的实例。
+func newIllegalParameterErrorWithCause(cause error, errMsg string) IllegalParameterError {
+	ipe := newIllegalParameterError(errMsg)
+	ipe.cause = cause
+	return ipe
+}
+
 func (ipe IllegalParameterError) Error() string {
 	return ipe.msg
 }
 
+func (ipe IllegalParameterError) Is(target error) bool {
+	return target == ErrIllegalParameter
+}
+
+func (ipe IllegalParameterError) Unwrap() error {
+	return ipe.cause
+}
+
 // IllegalPairTypeError 代表非法的键-元素对类型的错误类型。
 type IllegalPairTypeError struct {
 	msg string
@@ -34,6 +88,10 @@ func (ipte IllegalPairTypeError) Error() string {
 	return ipte.msg
 }
 
+func (ipte IllegalPairTypeError) Is(target error) bool {
+	return target == ErrIllegalPairType
+}
+
 // PairRedistributorError 代表无法再分布键-元素对的错误类型。
 type PairRedistributorError struct {
 	msg string
@@ -49,3 +107,94 @@ func newPairRedistributorError(errMsg string) PairRedistributorError {
 func (pre PairRedistributorError) Error() string {
 	return pre.msg
 }
+
+func (pre PairRedistributorError) Is(target error) bool {
+	return target == ErrPairRedistribution
+}
+
+// CorruptRecordError 代表读取到不完整或损坏的记录的错误类型。
+type CorruptRecordError struct {
+	msg string
+}
+
+// newCorruptRecordError 会创建一个CorruptRecordError类型的实例。
+func newCorruptRecordError(offset int64, errMsg string) CorruptRecordError {
+	return CorruptRecordError{
+		msg: fmt.Sprintf("concurrent map: corrupt record at offset %d: %s", offset, errMsg),
+	}
+}
+
+func (cre CorruptRecordError) Error() string {
+	return cre.msg
+}
+
+func (cre CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+// CallbackPanicError 代表回调函数引发panic的错误类型。
+type CallbackPanicError struct {
+	msg   string
+	value interface{}
+}
+
+// newCallbackPanicError 会创建一个CallbackPanicError类型的实例。
+func newCallbackPanicError(value interface{}) CallbackPanicError {
+	return CallbackPanicError{
+		msg:   fmt.Sprintf("concurrent map: callback panicked: %v", value),
+		value: value,
+	}
+}
+
+func (cpe CallbackPanicError) Error() string {
+	return cpe.msg
+}
+
+func (cpe CallbackPanicError) Is(target error) bool {
+	return target == ErrCallbackPanic
+}
+
+// Value 返回传给panic的值
+func (cpe CallbackPanicError) Value() interface{} {
+	return cpe.value
+}
+
+// RetriesExhaustedError 代表乐观更新的重试次数耗尽的错误类型。
+type RetriesExhaustedError struct {
+	msg string
+}
+
+// newRetriesExhaustedError 会创建一个RetriesExhaustedError类型的实例。
+func newRetriesExhaustedError(key string, retries int) RetriesExhaustedError {
+	return RetriesExhaustedError{
+		msg: fmt.Sprintf("concurrent map: retries exhausted: key %q still conflicts after %d retries", key, retries),
+	}
+}
+
+func (ree RetriesExhaustedError) Error() string {
+	return ree.msg
+}
+
+func (ree RetriesExhaustedError) Is(target error) bool {
+	return target == ErrRetriesExhausted
+}
+
+// InvariantError 代表字典内部状态不一致的错误类型。
+type InvariantError struct {
+	msg string
+}
+
+// newInvariantError 会创建一个InvariantError类型的实例。
+func newInvariantError(errMsg string) InvariantError {
+	return InvariantError{
+		msg: fmt.Sprintf("concurrent map: invariant violated: %s", errMsg),
+	}
+}
+
+func (ie InvariantError) Error() string {
+	return ie.msg
+}
+
+func (ie InvariantError) Is(target error) bool {
+	return target == ErrInvariantViolated
+}
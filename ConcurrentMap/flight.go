@@ -0,0 +1,76 @@
+package concurrentMap
+
+import "sync"
+
+// flightCall 代表一次正在进行的GetOrCompute计算。
+type flightCall struct {
+	// 计算结束后被关闭
+	done    chan struct{}
+	element interface{}
+	err     error
+}
+
+// flightGroup 记录每个键正在进行的计算，使同一个键同一时刻最多只有一次计算。
+// 它的零值即可使用。
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do 在key没有正在进行的计算时调用f并返回它的结果，否则等待那次计算结束并返回同样的结果。
+// f引发panic时panic会在当前协程中继续传播，等待者得到CallbackPanicError
+func (g *flightGroup) do(key string, f func() (interface{}, error)) (interface{}, error) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		<-c.done
+		return c.element, c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+	finished := false
+	defer func() {
+		if !finished {
+			v := recover()
+			c.err = newCallbackPanicError(v)
+			g.finish(key, c)
+			panic(v)
+		}
+		g.finish(key, c)
+	}()
+	c.element, c.err = f()
+	finished = true
+	return c.element, c.err
+}
+
+// finish 会移除key的计算记录并唤醒所有等待者
+func (g *flightGroup) finish(key string, c *flightCall) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(c.done)
+}
+
+func (cmap *myConcurrentMap) GetOrCompute(key string, compute func() (interface{}, error)) (interface{}, error) {
+	if element, ok := cmap.Load(key); ok {
+		return element, nil
+	}
+	return cmap.flights.do(cmap.normalize(key), func() (interface{}, error) {
+		// 在等待获得计算权的期间，键可能已被之前的计算或其他写操作放入
+		if element, ok := cmap.Load(key); ok {
+			return element, nil
+		}
+		element, err := compute()
+		if err != nil {
+			return nil, err
+		}
+		actual, _ := cmap.GetOrPut(key, func() interface{} {
+			return element
+		})
+		return actual, nil
+	})
+}
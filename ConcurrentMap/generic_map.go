@@ -0,0 +1,206 @@
+package concurrentMap
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Map 代表键类型为K、元素类型为V的并发安全字典。
+//
+// 它沿用了ConcurrentMap的结构：散列段各自持有锁，散列桶是写时复制的单链表，
+// 因此读操作不会加锁。键和元素以原本的类型保存在键 - 元素对中，
+// 不需要把键转换为字符串，也不需要对元素装箱。
+//
+// ConcurrentMap没有成为Map[string, interface{}]的别名，
+// 因为它的Pair、Bucket和PairRedistributor等接口以及TTL、LRU等配置项
+// 都以字符串键为前提，改为别名会破坏已有的调用方。
+type Map[K comparable, V any] struct {
+	hashFunc func(key K) uint64
+	shards   []*mapShard[K, V]
+}
+
+// mapShard 代表Map的散列段。
+type mapShard[K comparable, V any] struct {
+	lock sync.Mutex
+	// 指向当前散列桶表头列表的指针，类型为*[]unsafe.Pointer
+	table unsafe.Pointer
+	total uint64
+}
+
+// typedPair 代表Map的键 - 元素对，它一旦被链接进散列桶就不会再被改动。
+type typedPair[K comparable, V any] struct {
+	key     K
+	hash    uint64
+	element V
+	next    *typedPair[K, V]
+}
+
+// NewMap 会创建一个Map类型的实例，hashFunc用于计算键的散列值。
+func NewMap[K comparable, V any](concurrency int, hashFunc func(key K) uint64) (*Map[K, V], error) {
+	if concurrency <= 0 {
+		return nil, newIllegalParameterErrorWithCause(ErrInvalidConcurrency, "concurrency is too small")
+	}
+	if concurrency > MAX_CONCURRENCY {
+		return nil, newIllegalParameterErrorWithCause(ErrInvalidConcurrency, "concurrency is too large")
+	}
+	if hashFunc == nil {
+		return nil, newIllegalParameterErrorWithCause(ErrNilHashFunc, "hash function is nil")
+	}
+	m := &Map[K, V]{
+		hashFunc: hashFunc,
+		shards:   make([]*mapShard[K, V], concurrency),
+	}
+	for i := range m.shards {
+		table := make([]unsafe.Pointer, DEFAULT_BUCKET_NUMBER)
+		m.shards[i] = &mapShard[K, V]{table: unsafe.Pointer(&table)}
+	}
+	return m, nil
+}
+
+// Get 返回键对应的元素，键不存在时返回V的零值和false。
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	keyHash := m.hash(key)
+	for p := m.shardFor(keyHash).head(keyHash); p != nil; p = p.next {
+		if p.key == key {
+			return p.element, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Put 放入一个键 - 元素对，返回键是否是新增的。
+func (m *Map[K, V]) Put(key K, element V) bool {
+	keyHash := m.hash(key)
+	s := m.shardFor(keyHash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	table := s.loadTable()
+	index := keyHash % uint64(len(table))
+	first := (*typedPair[K, V])(atomic.LoadPointer(&table[index]))
+	p := &typedPair[K, V]{key: key, hash: keyHash, element: element}
+	target := findTypedPair(first, key)
+	if target != nil {
+		p.next = target.next
+		atomic.StorePointer(&table[index], unsafe.Pointer(relinkTyped(first, target, p)))
+		return false
+	}
+	p.next = first
+	atomic.StorePointer(&table[index], unsafe.Pointer(p))
+	if total := atomic.AddUint64(&s.total, 1); float64(total) > float64(len(table))*DEFAULT_BUCKET_LOAD_FACTOR {
+		s.grow(table)
+	}
+	return true
+}
+
+// Delete 删除键对应的键 - 元素对，返回键是否存在。
+func (m *Map[K, V]) Delete(key K) bool {
+	keyHash := m.hash(key)
+	s := m.shardFor(keyHash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	table := s.loadTable()
+	index := keyHash % uint64(len(table))
+	first := (*typedPair[K, V])(atomic.LoadPointer(&table[index]))
+	target := findTypedPair(first, key)
+	if target == nil {
+		return false
+	}
+	atomic.StorePointer(&table[index], unsafe.Pointer(relinkTyped(first, target, target.next)))
+	atomic.AddUint64(&s.total, ^uint64(0))
+	return true
+}
+
+// Len 返回键 - 元素对的总数。
+func (m *Map[K, V]) Len() uint64 {
+	var total uint64
+	for _, s := range m.shards {
+		total += atomic.LoadUint64(&s.total)
+	}
+	return total
+}
+
+// Range 依次把每个键 - 元素对传给f，f返回false时停止遍历。
+// 遍历期间的并发修改可能被观察到也可能不会。
+func (m *Map[K, V]) Range(f func(key K, element V) bool) {
+	for _, s := range m.shards {
+		table := s.loadTable()
+		for i := range table {
+			for p := (*typedPair[K, V])(atomic.LoadPointer(&table[i])); p != nil; p = p.next {
+				if !f(p.key, p.element) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// hash 会打散用户给出的散列值，
+// 以免像整数恒等散列这样的函数让散列段与散列桶的选择互相关联
+func (m *Map[K, V]) hash(key K) uint64 {
+	h := m.hashFunc(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (m *Map[K, V]) shardFor(keyHash uint64) *mapShard[K, V] {
+	return m.shards[(keyHash>>32)%uint64(len(m.shards))]
+}
+
+func (s *mapShard[K, V]) loadTable() []unsafe.Pointer {
+	return *(*[]unsafe.Pointer)(atomic.LoadPointer(&s.table))
+}
+
+// head 返回键散列值所属散列桶的表头
+func (s *mapShard[K, V]) head(keyHash uint64) *typedPair[K, V] {
+	table := s.loadTable()
+	return (*typedPair[K, V])(atomic.LoadPointer(&table[keyHash%uint64(len(table))]))
+}
+
+// grow 在持有锁的情况下把散列桶数量翻倍。
+// 新的散列桶由键 - 元素对的副本组成，正在读取旧散列桶的读操作不受影响
+func (s *mapShard[K, V]) grow(table []unsafe.Pointer) {
+	newTable := make([]unsafe.Pointer, len(table)<<1)
+	for i := range table {
+		for p := (*typedPair[K, V])(atomic.LoadPointer(&table[i])); p != nil; p = p.next {
+			index := p.hash % uint64(len(newTable))
+			newTable[index] = unsafe.Pointer(&typedPair[K, V]{
+				key:     p.key,
+				hash:    p.hash,
+				element: p.element,
+				next:    (*typedPair[K, V])(newTable[index]),
+			})
+		}
+	}
+	atomic.StorePointer(&s.table, unsafe.Pointer(&newTable))
+}
+
+// findTypedPair 返回从first开始的链表中键为key的键 - 元素对
+func findTypedPair[K comparable, V any](first *typedPair[K, V], key K) *typedPair[K, V] {
+	for p := first; p != nil; p = p.next {
+		if p.key == key {
+			return p
+		}
+	}
+	return nil
+}
+
+// relinkTyped 与relink相同，会复制target之前的键 - 元素对并让最后一个副本指向tail
+func relinkTyped[K comparable, V any](first, target, tail *typedPair[K, V]) *typedPair[K, V] {
+	if first == target {
+		return tail
+	}
+	head := &typedPair[K, V]{key: first.key, hash: first.hash, element: first.element}
+	last := head
+	for p := first.next; p != target; p = p.next {
+		last.next = &typedPair[K, V]{key: p.key, hash: p.hash, element: p.element}
+		last = last.next
+	}
+	last.next = tail
+	return head
+}
@@ -0,0 +1,64 @@
+package concurrentMap
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// gobPair 代表用于gob编码的键-元素对。
+// TTL用于在WithRefreshOnGet下继续延长过期时间，Version让解码后的版本号与编码前保持一致
+type gobPair struct {
+	Key        string
+	Element    interface{}
+	Expiration int64
+	TTL        int64
+	Version    uint64
+}
+
+func (cmap *myConcurrentMap) GobEncode() ([]byte, error) {
+	now := cmap.now()
+	pairs := make([]gobPair, 0, cmap.Len())
+	for _, s := range cmap.segments {
+		for _, p := range s.CopyPairs() {
+			if isExpired(p, now) {
+				continue
+			}
+			pairs = append(pairs, gobPair{
+				Key:        displayKey(p),
+				Element:    p.Element(),
+				Expiration: p.Expiration(),
+				TTL:        pairTTL(p),
+				Version:    pairVersion(p),
+			})
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pairs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cmap *myConcurrentMap) GobDecode(data []byte) error {
+	var pairs []gobPair
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&pairs); err != nil {
+		return err
+	}
+	cmap.reset()
+	for _, gp := range pairs {
+		p, err := cmap.newPair(gp.Key, gp.Element)
+		if err != nil {
+			return err
+		}
+		p.SetExpiration(gp.Expiration)
+		p.(*pair).ttl = gp.TTL
+		p.(*pair).version = gp.Version
+		if ok, err := cmap.findSegment(p.Hash()).Put(p); err != nil {
+			return err
+		} else if ok {
+			cmap.addTotal(1)
+		}
+		cmap.sweepIfExpiring(p)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package concurrentMap
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// secondaryIndex 代表按元素计算出的索引键到主键集合的映射。
+type secondaryIndex struct {
+	keyFunc func(element interface{}) string
+	lock    sync.Mutex
+	// 索引键到以它为索引键的主键集合的映射
+	entries map[string]map[string]struct{}
+	// 主键到它当前所在索引键的映射，用于在覆盖和删除时找到旧的位置
+	indexKeys map[string]string
+}
+
+// newSecondaryIndex 会创建一个secondaryIndex类型的实例。
+func newSecondaryIndex(keyFunc func(element interface{}) string) *secondaryIndex {
+	return &secondaryIndex{
+		keyFunc:   keyFunc,
+		entries:   make(map[string]map[string]struct{}),
+		indexKeys: make(map[string]string),
+	}
+}
+
+func (idx *secondaryIndex) pairStored(key string, element interface{}) {
+	indexKey := idx.keyFunc(element)
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, ok := idx.indexKeys[key]; ok {
+		if old == indexKey {
+			return
+		}
+		idx.unlink(key, old)
+	}
+	keys := idx.entries[indexKey]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		idx.entries[indexKey] = keys
+	}
+	keys[key] = struct{}{}
+	idx.indexKeys[key] = indexKey
+}
+
+func (idx *secondaryIndex) pairRemoved(key string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, ok := idx.indexKeys[key]; ok {
+		idx.unlink(key, old)
+		delete(idx.indexKeys, key)
+	}
+}
+
+// unlink 在持有锁的情况下把主键从索引键的集合中移除，集合为空时一并删除
+func (idx *secondaryIndex) unlink(key, indexKey string) {
+	keys := idx.entries[indexKey]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(idx.entries, indexKey)
+	}
+}
+
+// query 会按字典序返回以indexKey为索引键的主键
+func (idx *secondaryIndex) query(indexKey string) []string {
+	idx.lock.Lock()
+	keys := make([]string, 0, len(idx.entries[indexKey]))
+	for key := range idx.entries[indexKey] {
+		keys = append(keys, key)
+	}
+	idx.lock.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// indexSet 代表字典的全部二级索引，它作为散列段的监听器使用。
+// 没有任何索引时事件只需一次原子读取即可跳过。
+type indexSet struct {
+	lock    sync.RWMutex
+	indexes map[string]*secondaryIndex
+	count   int32
+}
+
+// newIndexSet 会创建一个indexSet类型的实例。
+func newIndexSet() *indexSet {
+	return &indexSet{indexes: make(map[string]*secondaryIndex)}
+}
+
+func (is *indexSet) pairStored(key string, element interface{}) {
+	if atomic.LoadInt32(&is.count) == 0 {
+		return
+	}
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+	for _, idx := range is.indexes {
+		idx.pairStored(key, element)
+	}
+}
+
+func (is *indexSet) pairRemoved(key string) {
+	if atomic.LoadInt32(&is.count) == 0 {
+		return
+	}
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+	for _, idx := range is.indexes {
+		idx.pairRemoved(key)
+	}
+}
+
+// reset 会清空每个索引的内容，但保留索引本身
+func (is *indexSet) reset() {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	for name, idx := range is.indexes {
+		is.indexes[name] = newSecondaryIndex(idx.keyFunc)
+	}
+}
+
+func (cmap *myConcurrentMap) AddIndex(name string, keyFunc func(element interface{}) string) error {
+	if keyFunc == nil {
+		return newIllegalParameterError("index key function is nil")
+	}
+	// 持有全部散列段的写锁，使索引在建立期间不会错过并发的写操作
+	for _, s := range cmap.segments {
+		s.Lock()
+	}
+	defer func() {
+		for i := len(cmap.segments) - 1; i >= 0; i-- {
+			cmap.segments[i].Unlock()
+		}
+	}()
+	cmap.indexes.lock.Lock()
+	defer cmap.indexes.lock.Unlock()
+	if _, ok := cmap.indexes.indexes[name]; ok {
+		return newIllegalParameterError("index " + name + " already exists")
+	}
+	idx := newSecondaryIndex(keyFunc)
+	for _, s := range cmap.segments {
+		s.RangeLocked(func(p Pair) bool {
+			idx.pairStored(p.Key(), p.Element())
+			return true
+		})
+	}
+	cmap.indexes.indexes[name] = idx
+	atomic.AddInt32(&cmap.indexes.count, 1)
+	return nil
+}
+
+func (cmap *myConcurrentMap) QueryIndex(name, indexKey string) []string {
+	cmap.indexes.lock.RLock()
+	idx := cmap.indexes.indexes[name]
+	cmap.indexes.lock.RUnlock()
+	if idx == nil {
+		return nil
+	}
+	return idx.query(indexKey)
+}
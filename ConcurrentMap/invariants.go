@@ -0,0 +1,55 @@
+package concurrentMap
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+func (cmap *myConcurrentMap) CheckInvariants() error {
+	var sum uint64
+	for i, s := range cmap.segments {
+		if err := s.CheckInvariants(); err != nil {
+			return newInvariantError(fmt.Sprintf("segment %d: %s", i, err))
+		}
+		sum += s.Size()
+	}
+	if total := atomic.LoadUint64(&cmap.total); total != sum {
+		return newInvariantError(fmt.Sprintf("total is %d but segments hold %d pairs", total, sum))
+	}
+	return nil
+}
+
+func (s *segment) CheckInvariants() error {
+	s.lock.Lock()
+	defer s.unlock()
+	locate := s.locator()
+	var sum uint64
+	for i, b := range s.liveBuckets() {
+		var length uint64
+		seen := make(map[string]bool)
+		for _, p := range b.Pairs() {
+			if isEmpty(p) {
+				return fmt.Errorf("bucket %d: placeholder inside the chain", i)
+			}
+			if seen[p.Key()] {
+				return fmt.Errorf("bucket %d: duplicate key %q", i, p.Key())
+			}
+			seen[p.Key()] = true
+			if keyHash := s.hashFunc(p.Key()); p.Hash() != keyHash {
+				return fmt.Errorf("bucket %d: key %q has hash %d, expected %d", i, p.Key(), p.Hash(), keyHash)
+			}
+			if index := locate(p.Hash()); index != i {
+				return fmt.Errorf("bucket %d: key %q belongs to bucket %d", i, p.Key(), index)
+			}
+			length++
+		}
+		if size := b.Size(); size != length {
+			return fmt.Errorf("bucket %d: size is %d but the chain has %d pairs", i, size, length)
+		}
+		sum += length
+	}
+	if total := atomic.LoadUint64(&s.pairTotal); total != sum {
+		return fmt.Errorf("pair total is %d but buckets hold %d pairs", total, sum)
+	}
+	return nil
+}
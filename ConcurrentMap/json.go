@@ -0,0 +1,21 @@
+package concurrentMap
+
+import "encoding/json"
+
+func (cmap *myConcurrentMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cmap.ToMap())
+}
+
+func (cmap *myConcurrentMap) UnmarshalJSON(data []byte) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	cmap.reset()
+	for key, element := range m {
+		if _, err := cmap.Put(key, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package concurrentMap
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// lruList 代表按访问顺序排列键的列表。
+// 它作为散列段的监听器使用，因此其内容总是与字典保持一致。
+// 键按散列值分布到多个分片中，每个分片有自己的锁，读写只会锁住键所在的分片；
+// 每次访问都会记录一个全局递增的序号，淘汰时比较各分片表尾的序号，因此仍然是精确的LRU。
+type lruList struct {
+	shards   []lruShard
+	hashFunc func(key string) uint64
+	// 最近一次分配的访问序号
+	ticks uint64
+}
+
+// lruShard 代表lruList的一个分片，表头为分片内最近访问的键。
+type lruShard struct {
+	lock     sync.Mutex
+	list     *list.List
+	elements map[string]*list.Element
+}
+
+// lruEntry 代表分片中的一个键及其最近一次访问的序号。
+type lruEntry struct {
+	key  string
+	tick uint64
+}
+
+// newLRUList 会创建一个包含shards个分片、用hashFunc把键分配到分片的lruList类型的实例。
+func newLRUList(shards int, hashFunc func(key string) uint64) *lruList {
+	if shards <= 0 {
+		shards = 1
+	}
+	l := &lruList{shards: make([]lruShard, shards), hashFunc: hashFunc}
+	for i := range l.shards {
+		l.shards[i].list = list.New()
+		l.shards[i].elements = make(map[string]*list.Element)
+	}
+	return l
+}
+
+// shard 返回键所在的分片
+func (l *lruList) shard(key string) *lruShard {
+	return &l.shards[l.hashFunc(key)%uint64(len(l.shards))]
+}
+
+func (l *lruList) pairStored(key string, element interface{}) {
+	s := l.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// 在分片的锁内分配序号，使分片内的链表总是按序号排列
+	tick := atomic.AddUint64(&l.ticks, 1)
+	if e, ok := s.elements[key]; ok {
+		e.Value.(*lruEntry).tick = tick
+		s.list.MoveToFront(e)
+		return
+	}
+	s.elements[key] = s.list.PushFront(&lruEntry{key: key, tick: tick})
+}
+
+func (l *lruList) pairRemoved(key string) {
+	s := l.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.elements[key]; ok {
+		s.list.Remove(e)
+		delete(s.elements, key)
+	}
+}
+
+// access 会把已存在的键移到表头，不存在的键会被忽略。
+func (l *lruList) access(key string) {
+	s := l.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.elements[key]; ok {
+		e.Value.(*lruEntry).tick = atomic.AddUint64(&l.ticks, 1)
+		s.list.MoveToFront(e)
+	}
+}
+
+// popOldest 会移除并返回最久未被访问的键。
+// 它依次查看每个分片的表尾，再从序号最小的分片中移除表尾；
+// 两步之间其他操作可能改动了那个分片，此时移除的是它新的表尾
+func (l *lruList) popOldest() (string, bool) {
+	for {
+		oldest := -1
+		var oldestTick uint64
+		for i := range l.shards {
+			s := &l.shards[i]
+			s.lock.Lock()
+			if e := s.list.Back(); e != nil {
+				if tick := e.Value.(*lruEntry).tick; oldest < 0 || tick < oldestTick {
+					oldest, oldestTick = i, tick
+				}
+			}
+			s.lock.Unlock()
+		}
+		if oldest < 0 {
+			return "", false
+		}
+		s := &l.shards[oldest]
+		s.lock.Lock()
+		e := s.list.Back()
+		if e == nil {
+			// 分片在查看之后被清空，重新查找
+			s.lock.Unlock()
+			continue
+		}
+		key := e.Value.(*lruEntry).key
+		s.list.Remove(e)
+		delete(s.elements, key)
+		s.lock.Unlock()
+		return key, true
+	}
+}
+
+// evict 会淘汰最久未被访问的键-元素对，直到总数不超过最大尺寸
+func (cmap *myConcurrentMap) evict() {
+	for cmap.Len() > cmap.opts.maxSize {
+		key, ok := cmap.lru.popOldest()
+		if !ok {
+			return
+		}
+		cmap.delete(key)
+	}
+}
@@ -0,0 +1,22 @@
+package concurrentMap
+
+import "time"
+
+// Observer 代表字典操作的观察者，可用于统计命中率等指标。
+// 它的方法不会在持有散列段锁的情况下被调用，但可能被并发调用。
+type Observer interface {
+	// OnPut 会在每次放入后被调用，inserted代表是否新增了键-元素对
+	OnPut(inserted bool)
+	// OnGet 会在每次查找后被调用，hit代表键是否存在
+	OnGet(hit bool)
+	// OnDelete 会在每次删除后被调用，found代表键是否存在
+	OnDelete(found bool)
+	// OnResize 会在散列段的散列桶数量变化后被调用
+	OnResize(oldBuckets, newBuckets int)
+}
+
+// LatencyObserver 是可以由Observer额外实现的接口，用于接收WithLatencySampling采样到的读取耗时。
+type LatencyObserver interface {
+	// OnGetLatency 会在被采样的Get或Load返回前被调用，d为它的耗时
+	OnGetLatency(d time.Duration)
+}
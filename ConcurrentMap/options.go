@@ -0,0 +1,358 @@
+package concurrentMap
+
+import (
+	"sync"
+	"time"
+)
+
+// Option 代表创建字典时的可选配置项。
+type Option func(opts *options) error
+
+// options 代表字典的可选配置。
+type options struct {
+	// 计算键散列值的函数
+	hashFunc func(key string) uint64
+	// 每个散列段初始的散列桶数量
+	bucketNumber int
+	// 默认再分布器使用的装载因子
+	loadFactor float64
+	// 散列段是否使用读写锁
+	rwLock bool
+	// 键-元素对的最大数量，0代表不限制
+	maxSize uint64
+	// 操作的观察者，nil代表不观察
+	observer Observer
+	// String输出的键-元素对数量上限，0代表不限制
+	stringLimit int
+	// 键-元素对离开字典时的回调，nil代表不回调
+	onEvict func(key string, element interface{})
+	// 默认再分布器是否使用一致性散列
+	consistentHashing bool
+	// 默认再分布器允许的散列桶链表长度上限，0代表使用DEFAULT_BUCKET_MAX_SIZE
+	maxChainLength uint64
+	// 读取时是否刷新带有ttl的键-元素对的过期时间
+	refreshOnGet bool
+	// 每个散列段中散列桶共用的锁的数量，0代表每个散列桶使用自己的锁
+	lockStripes int
+	// 复用键-元素对的池，nil代表不复用
+	pairPool *sync.Pool
+	// 在散列和比较之前规范化键的函数，nil代表不规范化
+	keyNormalizer func(key string) string
+	// Range是否按放入顺序遍历
+	insertionOrder bool
+	// 按放入顺序遍历时，覆盖已有的键是否把它移到最后
+	refreshOrderOnPut bool
+	// 渐进式再散列时每次写操作顺带迁移的散列桶数量，0代表一次性再散列
+	migrateStep int
+	// 在散列桶中比较键的函数，nil代表使用==
+	keyEquals func(a, b string) bool
+	// 存取元素时复制元素的函数，nil代表不复制
+	valueCopier func(element interface{}) interface{}
+	// 按放入顺序淘汰时键-元素对的最大数量，0代表不限制
+	fifoCapacity uint64
+	// 读取命中时是否把键-元素对移到所在链表的表头
+	moveToFront bool
+	// 被采样测量耗时的Get的比例，0代表不采样
+	latencyRate float64
+	// 判断键-元素对是否过期时使用的时钟
+	clock func() time.Time
+}
+
+// defaultOptions 会返回默认的可选配置。
+func defaultOptions() options {
+	return options{
+		hashFunc:     hash,
+		bucketNumber: DEFAULT_BUCKET_NUMBER,
+		loadFactor:   DEFAULT_BUCKET_LOAD_FACTOR,
+		clock:        time.Now,
+	}
+}
+
+// WithHashFunc 用于指定计算键散列值的函数，
+// 它会被Put、Get、Delete以及再散列一致地使用。
+func WithHashFunc(hashFunc func(key string) uint64) Option {
+	return func(opts *options) error {
+		if hashFunc == nil {
+			return newIllegalParameterErrorWithCause(ErrNilHashFunc, "hash function is nil")
+		}
+		opts.hashFunc = hashFunc
+		return nil
+	}
+}
+
+// WithClock 用于指定计算和判断过期时间时使用的时钟，默认为time.Now。
+// 后台清理协程仍按真实时间周期性地运行，但每次运行时以clock判断哪些键-元素对已过期。
+func WithClock(clock func() time.Time) Option {
+	return func(opts *options) error {
+		if clock == nil {
+			return newIllegalParameterError("clock is nil")
+		}
+		opts.clock = clock
+		return nil
+	}
+}
+
+// WithLoadFactor 用于指定默认再分布器的装载因子。
+// 当散列段的键-元素对总数超过散列桶数量与它的乘积时，散列桶数量会翻倍。
+func WithLoadFactor(loadFactor float64) Option {
+	return func(opts *options) error {
+		if loadFactor <= 0 {
+			return newIllegalParameterError("load factor is not positive")
+		}
+		opts.loadFactor = loadFactor
+		return nil
+	}
+}
+
+// WithRWLock 用于让每个散列段使用读写锁，
+// 此时Get等只读操作只会获取读锁，适合读多写少的场景。
+func WithRWLock() Option {
+	return func(opts *options) error {
+		opts.rwLock = true
+		return nil
+	}
+}
+
+// WithMaxSize 用于限制键-元素对的最大数量。
+// 设置后字典会按Get和Put记录访问顺序，
+// 并在新增键-元素对使总数超过maxSize时淘汰最久未被访问的键-元素对。
+// 访问顺序按键的散列值分片记录，分片数量与并发量相同，每次读写只锁住键所在的分片；
+// 淘汰时需要依次查看所有分片，因此它的开销随并发量增长。
+func WithMaxSize(maxSize uint64) Option {
+	return func(opts *options) error {
+		if maxSize == 0 {
+			return newIllegalParameterError("max size is zero")
+		}
+		opts.maxSize = maxSize
+		return nil
+	}
+}
+
+// WithObserver 用于设置字典操作的观察者。
+func WithObserver(observer Observer) Option {
+	return func(opts *options) error {
+		if observer == nil {
+			return newIllegalParameterError("observer is nil")
+		}
+		opts.observer = observer
+		return nil
+	}
+}
+
+// WithCapacityFIFO 用于按放入顺序限制键-元素对的最大数量。
+// 新增键-元素对使总数超过capacity时，最早放入的键-元素对会被淘汰，
+// 读取和覆盖都不会延长键-元素对在字典中的寿命，这是它与WithMaxSize的区别。
+// 两者同时设置时各自独立地淘汰
+func WithCapacityFIFO(capacity uint64) Option {
+	return func(opts *options) error {
+		if capacity == 0 {
+			return newIllegalParameterError("fifo capacity is zero")
+		}
+		opts.fifoCapacity = capacity
+		return nil
+	}
+}
+
+// WithInitialBuckets 用于指定每个散列段初始的散列桶数量，
+// 它不是2的幂时会被向上取整为2的幂。
+// 自动扩容会在此基础上翻倍散列桶数量。
+func WithInitialBuckets(bucketNumber int) Option {
+	return func(opts *options) error {
+		if bucketNumber <= 0 {
+			return newIllegalParameterErrorWithCause(ErrInvalidBucketCount, "bucket number is not positive")
+		}
+		n := 1
+		for n < bucketNumber {
+			n <<= 1
+		}
+		opts.bucketNumber = n
+		return nil
+	}
+}
+
+// WithStringLimit 用于限制String输出的键-元素对数量，
+// 超出部分会被省略，以免把巨大的字典整个写入日志。
+func WithStringLimit(limit int) Option {
+	return func(opts *options) error {
+		if limit <= 0 {
+			return newIllegalParameterError("string limit is not positive")
+		}
+		opts.stringLimit = limit
+		return nil
+	}
+}
+
+// WithEvictionCallback 用于设置元素离开字典时的回调。
+// Delete、Put覆盖、Clear、过期和LRU淘汰都会触发它。
+// 回调总是在释放字典内部的锁之后发生，因此可以在其中访问字典。
+// 同一个散列段的一次操作产生的回调按移除的顺序依次执行，
+// 不同散列段之间的回调没有顺序保证，并且可能被并发执行。
+func WithEvictionCallback(onEvict func(key string, element interface{})) Option {
+	return func(opts *options) error {
+		if onEvict == nil {
+			return newIllegalParameterError("eviction callback is nil")
+		}
+		opts.onEvict = onEvict
+		return nil
+	}
+}
+
+// WithConsistentHashing 用于让默认再分布器以一致性散列定位散列桶，
+// 扩容时散列桶数量每次增加一半，只有约三分之一的键需要换到新的散列桶。
+// 指定了自定义再分布器时此项不起作用。
+func WithConsistentHashing() Option {
+	return func(opts *options) error {
+		opts.consistentHashing = true
+		return nil
+	}
+}
+
+// WithPairPool 用于让字典通过sync.Pool复用被覆盖或删除的键-元素对，
+// 以减少频繁写入时的内存分配。
+// 被移除的键-元素对只有在没有无锁读操作可能访问到它时才会被放回池中，
+// 此时Snapshot会复制键-元素对而不再只记录表头。
+// 删除时为前驱生成的副本会替换掉原有的前驱，这些被替换的前驱不会放回池中，
+// 因此池只能抵消被删除或覆盖的那一个键-元素对的分配。
+func WithPairPool() Option {
+	return func(opts *options) error {
+		opts.pairPool = &sync.Pool{
+			New: func() interface{} {
+				return &pair{}
+			},
+		}
+		return nil
+	}
+}
+
+// WithMaxChainLength 用于指定默认再分布器允许的散列桶链表长度上限，
+// 某个散列桶的链表超过它时散列段会扩容，以防大量键集中到同一个散列桶。
+// 默认值为DEFAULT_BUCKET_MAX_SIZE，指定了自定义再分布器时此项不起作用。
+func WithMaxChainLength(maxChainLength int) Option {
+	return func(opts *options) error {
+		if maxChainLength <= 0 {
+			return newIllegalParameterError("max chain length is not positive")
+		}
+		opts.maxChainLength = uint64(maxChainLength)
+		return nil
+	}
+}
+
+// WithRefreshOnGet 用于让Get、Load和Contains在命中以PutWithTTL放入的键-元素对时
+// 把它的过期时间重置为当前时刻加上放入时给定的ttl，
+// 这样只有在ttl内没有被访问的键-元素对才会过期并被清理。
+func WithRefreshOnGet(refresh bool) Option {
+	return func(opts *options) error {
+		opts.refreshOnGet = refresh
+		return nil
+	}
+}
+
+// WithLockStripes 用于让每个散列段中的散列桶共用n把锁，第i个散列桶使用第i%n把，
+// 以便在散列桶很多时节省为每个散列桶分配锁的内存。
+// 散列桶的锁只会在持有散列段的锁之后获取，并且同一时刻最多持有其中一把，
+// 因此再散列时不存在加锁顺序的问题。
+func WithLockStripes(n int) Option {
+	return func(opts *options) error {
+		if n <= 0 {
+			return newIllegalParameterError("lock stripes is not positive")
+		}
+		opts.lockStripes = n
+		return nil
+	}
+}
+
+// WithKeyNormalizer 用于指定规范化键的函数，例如strings.ToLower。
+// 所有接受键的方法都会先规范化键再散列和比较，因此规范化结果相同的键被视为同一个键。
+// 键-元素对会保留放入时的原始键，Range、Keys等遍历方法返回的是原始键；
+// 通过Compute、GetOrPut等只接受键的方法新增的键只保留规范化之后的形式。
+func WithKeyNormalizer(normalize func(key string) string) Option {
+	return func(opts *options) error {
+		if normalize == nil {
+			return newIllegalParameterError("key normalizer is nil")
+		}
+		opts.keyNormalizer = normalize
+		return nil
+	}
+}
+
+// WithInsertionOrder 用于让Range以及基于它的Keys、Values等方法按键的放入顺序遍历，
+// 字典会为此额外维护一个键的有序列表，删除键时也会把它从列表中移除。
+// refreshOnPut为true时覆盖已有的键会把它移到最后，否则保持它首次放入时的位置。
+// 它与WithMaxSize的LRU顺序相互独立
+func WithInsertionOrder(refreshOnPut bool) Option {
+	return func(opts *options) error {
+		opts.insertionOrder = true
+		opts.refreshOrderOnPut = refreshOnPut
+		return nil
+	}
+}
+
+// WithIncrementalResize 用于让默认再分布器触发的再散列渐进地进行：
+// 散列段先换上新的散列桶，此后每次写操作会迁移自己要访问的旧散列桶，
+// 并顺带按顺序迁移step个旧散列桶，因此单次Put不再承担整个散列段的再散列开销。
+// 迁移期间读操作会根据旧散列桶是否已迁移决定查找旧散列桶还是新散列桶。
+// Compact和Reserve会先完成正在进行的迁移。
+func WithIncrementalResize(step int) Option {
+	return func(opts *options) error {
+		if step <= 0 {
+			return newIllegalParameterError("incremental resize step is not positive")
+		}
+		opts.migrateStep = step
+		return nil
+	}
+}
+
+// WithMoveToFrontOnGet 用于让Get、Load和Contains在命中时把键-元素对移到所在散列桶链表的表头，
+// 使经常被访问的键在链表较长时能更快地被找到，适合访问集中在少数键上的场景。
+// 移动同样是写时复制的，正在遍历旧链表的读操作不受影响；
+// 散列桶的锁被占用时读操作会放弃移动而不是等待，因此它不会让读操作阻塞在写操作上。
+// 移动需要复制键-元素对之前的整段链表，因此只有位置不超过MOVE_TO_FRONT_MAX_DEPTH的键-元素对才会被移动。
+// 与WithRefreshOnGet同时使用时，刷新的是移动后留在链表中的副本。
+func WithMoveToFrontOnGet() Option {
+	return func(opts *options) error {
+		opts.moveToFront = true
+		return nil
+	}
+}
+
+// WithLatencySampling 用于对比例为rate的Get和Load测量耗时，并交给观察者的OnGetLatency。
+// 观察者需要通过WithObserver设置并实现LatencyObserver，否则此项不起作用。
+// 是否采样由一个原子计数器决定，未被采样的调用不会读取时钟。
+func WithLatencySampling(rate float64) Option {
+	return func(opts *options) error {
+		if rate <= 0 || rate > 1 {
+			return newIllegalParameterError("latency sampling rate is not in (0, 1]")
+		}
+		opts.latencyRate = rate
+		return nil
+	}
+}
+
+// WithKeyEquals 用于指定在散列桶的链表中比较键的函数，以代替==。
+// 它必须与散列函数一致：equals判定相等的两个键必须具有相同的散列值，
+// 否则它们会落入不同的散列桶，查找也就无法找到对方，因此通常需要同时用WithHashFunc
+// 指定按同样规则计算的散列函数。覆盖时字典保存的是最后一次放入的键。
+// 只需要把键变换为统一形式时，WithKeyNormalizer更简单，也不必另外提供散列函数。
+func WithKeyEquals(equals func(a, b string) bool) Option {
+	return func(opts *options) error {
+		if equals == nil {
+			return newIllegalParameterError("key equals is nil")
+		}
+		opts.keyEquals = equals
+		return nil
+	}
+}
+
+// WithValueCopier 用于指定复制元素的函数，以免调用方修改字典中共享的元素。
+// Put等放入元素的方法以及Compute等方法存储的结果都会先经copier复制，
+// Get、Load、GetAll、GetOrPut等按键读取的方法返回的也是copier生成的副本。
+// Range等遍历方法和快照为了避免复制全部元素，仍然返回字典中的元素本身。
+func WithValueCopier(copier func(element interface{}) interface{}) Option {
+	return func(opts *options) error {
+		if copier == nil {
+			return newIllegalParameterError("value copier is nil")
+		}
+		opts.valueCopier = copier
+		return nil
+	}
+}
@@ -0,0 +1,119 @@
+package concurrentMap
+
+import (
+	"container/list"
+	"sync"
+)
+
+// orderList 代表按放入顺序排列键的列表，表头为最早放入的键。
+// 与lruList一样，它作为散列段的监听器使用，因此其内容总是与字典保持一致。
+type orderList struct {
+	lock     sync.Mutex
+	list     *list.List
+	elements map[string]*list.Element
+	// 覆盖已有的键时是否把它移到表尾
+	refreshOnPut bool
+}
+
+// newOrderList 会创建一个orderList类型的实例。
+func newOrderList(refreshOnPut bool) *orderList {
+	return &orderList{
+		list:         list.New(),
+		elements:     make(map[string]*list.Element),
+		refreshOnPut: refreshOnPut,
+	}
+}
+
+func (l *orderList) pairStored(key string, element interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.elements[key]; ok {
+		if l.refreshOnPut {
+			l.list.MoveToBack(e)
+		}
+		return
+	}
+	l.elements[key] = l.list.PushBack(key)
+}
+
+func (l *orderList) pairRemoved(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.elements[key]; ok {
+		l.list.Remove(e)
+		delete(l.elements, key)
+	}
+}
+
+// keys 会按放入顺序返回当前所有键的快照。
+func (l *orderList) keys() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keys := make([]string, 0, l.list.Len())
+	for e := l.list.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+// popOldest 会移除并返回最早放入的键。
+func (l *orderList) popOldest() (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e := l.list.Front()
+	if e == nil {
+		return "", false
+	}
+	key := e.Value.(string)
+	l.list.Remove(e)
+	delete(l.elements, key)
+	return key, true
+}
+
+// evictFIFO 会按放入顺序淘汰键-元素对，直到总数不超过WithCapacityFIFO给定的容量
+func (cmap *myConcurrentMap) evictFIFO() {
+	for cmap.Len() > cmap.opts.fifoCapacity {
+		key, ok := cmap.fifo.popOldest()
+		if !ok {
+			return
+		}
+		cmap.delete(key)
+	}
+}
+
+// pairListeners 会把事件依次转发给其中的每个监听器。
+type pairListeners []pairListener
+
+func (ls pairListeners) pairStored(key string, element interface{}) {
+	for _, l := range ls {
+		l.pairStored(key, element)
+	}
+}
+
+func (ls pairListeners) pairRemoved(key string) {
+	for _, l := range ls {
+		l.pairRemoved(key)
+	}
+}
+
+// rangeInOrder 按放入顺序对每个未过期的键-元素对调用f。
+// 键的顺序取自调用时的快照，之后被删除的键会被跳过
+func (cmap *myConcurrentMap) rangeInOrder(f func(key string, element interface{}) bool) {
+	now := cmap.now()
+	for _, key := range cmap.order.keys() {
+		keyHash := cmap.opts.hashFunc(key)
+		s := cmap.findSegment(keyHash)
+		s.BeginRead()
+		p := s.GetWithHash(key, keyHash)
+		var rawKey string
+		var element interface{}
+		found := p != nil && !isExpired(p, now)
+		if found {
+			rawKey, element = displayKey(p), p.Element()
+		}
+		s.EndRead()
+		if found && !f(rawKey, element) {
+			return
+		}
+	}
+}
@@ -11,10 +11,16 @@ import (
 type Pair interface {
 	linkedPair
 	Key() string
+	// Hash 返回创建时计算并缓存的键散列值，
+	// 再散列时会直接使用它而不会重新计算
 	Hash() uint64
 	Element() interface{}
 	SetElement(element interface{}) error
-	// Copy 生成一个键 - 元素对的副本并返回
+	// Expiration 返回过期时间（Unix纳秒），0代表永不过期
+	Expiration() int64
+	// SetExpiration 设置过期时间（Unix纳秒），0代表永不过期
+	SetExpiration(expiration int64)
+	// Copy 生成一个键 - 元素对的副本并返回，副本会保留缓存的散列值
 	Copy() Pair
 	// String 返回当前键 - 元素对的字符串表示形式
 	String() string
@@ -37,15 +43,34 @@ type pair struct {
 	hash    uint64
 	element unsafe.Pointer
 	next    unsafe.Pointer
+	// 过期时间（Unix纳秒），0代表永不过期
+	expiration int64
+	// 放入时给定的存活时长（纳秒），0代表没有给定，它在链接进散列桶之后不会改变
+	ttl int64
+	// 版本号，键首次放入时为1，每次覆盖都会在原有版本号的基础上加1
+	version uint64
+	// 规范化之前的原始键，为空代表与key相同
+	rawKey string
 }
 
+// NewPair 会创建一个可以传给BatchPut、TryPut等接受Pair的方法的键-元素对。
+// 空字符串也是合法的键。字典会按自己的散列函数和可选配置重新创建键-元素对，
+// 因此这里使用默认散列函数计算的散列值只在字典之外有意义，传入的实例也不会被链接进散列桶。
+func NewPair(key string, element interface{}) Pair {
+	p, _ := newPair(key, element)
+	return p
+}
+
+// newPair 会使用默认的散列函数创建一个Pair类型的实例。
 func newPair(key string, element interface{}) (Pair, error) {
+	return newPairWithHash(key, hash(key), element)
+}
+
+// newPairWithHash 会使用给定的键散列值创建一个Pair类型的实例。
+func newPairWithHash(key string, keyHash uint64, element interface{}) (Pair, error) {
 	p := &pair{
 		key:  key,
-		hash: 10000000, //todo hash(key)
-	}
-	if element == nil {
-		return nil, newIllegalParameterError("element is nil")
+		hash: keyHash,
 	}
 	p.element = unsafe.Pointer(&element)
 	return p, nil
@@ -68,15 +93,108 @@ func (p *pair) Element() interface{} {
 }
 
 func (p *pair) SetElement(element interface{}) error {
-	if element == nil {
-		return newIllegalParameterError("element is nil")
-	}
 	atomic.StorePointer(&p.element, unsafe.Pointer(&element))
 	return nil
 }
+func (p *pair) Expiration() int64 {
+	return atomic.LoadInt64(&p.expiration)
+}
+
+func (p *pair) SetExpiration(expiration int64) {
+	atomic.StoreInt64(&p.expiration, expiration)
+}
+
+// Copy 返回不带next的副本。装箱后的元素一旦存入就不会再被改动，
+// 因此副本直接共用原有的元素指针，每次复制只需分配pair本身
 func (p *pair) Copy() Pair {
-	pCopy, _ := newPair(p.Key(), p.Element())
-	return pCopy
+	return &pair{
+		key:        p.key,
+		hash:       p.hash,
+		element:    atomic.LoadPointer(&p.element),
+		expiration: atomic.LoadInt64(&p.expiration),
+		ttl:        p.ttl,
+		version:    p.version,
+		rawKey:     p.rawKey,
+	}
+}
+
+// displayKey 返回键 - 元素对放入时的原始键，没有记录原始键时返回Key()
+func displayKey(p Pair) string {
+	if pp, ok := p.(*pair); ok && pp.rawKey != "" {
+		return pp.rawKey
+	}
+	return p.Key()
+}
+
+// inheritRawKey 让np沿用p记录的原始键
+func inheritRawKey(np, p Pair) {
+	if npp, ok := np.(*pair); ok {
+		if pp, ok := p.(*pair); ok {
+			npp.rawKey = pp.rawKey
+		}
+	}
+}
+
+// pairVersion 返回键 - 元素对的版本号，p为nil或不是*pair时返回0
+func pairVersion(p Pair) uint64 {
+	if pp, ok := p.(*pair); ok {
+		return pp.version
+	}
+	return 0
+}
+
+// pairTTL 返回放入键 - 元素对时给定的存活时长（纳秒），p为nil、不是*pair或没有给定时返回0
+func pairTTL(p Pair) int64 {
+	if pp, ok := p.(*pair); ok {
+		return pp.ttl
+	}
+	return 0
+}
+
+// setVersion 在p链接进散列桶之前设置它的版本号：p已有版本号（例如由散列段分配）时保留它，
+// 否则覆盖previous时为previous的版本号加1，新增时为1
+func setVersion(p, previous Pair) {
+	pp, ok := p.(*pair)
+	if !ok || pp.version != 0 {
+		return
+	}
+	if previous != nil {
+		pp.version = pairVersion(previous) + 1
+	} else {
+		pp.version = 1
+	}
+}
+
+// inheritExpiration 让np沿用p的过期时间以及放入时给定的存活时长
+func inheritExpiration(np, p Pair) {
+	np.SetExpiration(p.Expiration())
+	if npp, ok := np.(*pair); ok {
+		if pp, ok := p.(*pair); ok {
+			npp.ttl = pp.ttl
+		}
+	}
+}
+
+// refreshExpiration 会把放入时给定了存活时长的键-元素对的过期时间推迟到now加上该时长。
+// 并发的刷新只会让过期时间向后移动，不会互相覆盖成更早的时刻
+func refreshExpiration(p Pair, now int64) {
+	pp, ok := p.(*pair)
+	if !ok || pp.ttl == 0 {
+		return
+	}
+	expiration := now + pp.ttl
+	for {
+		old := atomic.LoadInt64(&pp.expiration)
+		if old >= expiration || atomic.CompareAndSwapInt64(&pp.expiration, old, expiration) {
+			return
+		}
+	}
+}
+
+// isExpired 用于判断键-元素对在给定时刻是否已过期
+func isExpired(p Pair, now int64) bool {
+	expiration := p.Expiration()
+	return expiration > 0 && expiration <= now
 }
 
 func (p *pair) String() string {
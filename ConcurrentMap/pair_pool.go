@@ -0,0 +1,44 @@
+package concurrentMap
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// maxRetiredPairs 代表每个散列段最多积压的待回收键 - 元素对数量。
+const maxRetiredPairs = 1024
+
+// acquirePair 会从池中取出一个键 - 元素对并用给定参数初始化它。
+func acquirePair(pool *sync.Pool, key string, keyHash uint64, element interface{}) (Pair, error) {
+	p := pool.Get().(*pair)
+	p.key = key
+	p.hash = keyHash
+	p.element = unsafe.Pointer(&element)
+	return p, nil
+}
+
+// releasePair 会清除键 - 元素对的内容并把它放回池中，
+// 调用方必须保证已经没有任何读操作能访问到它。
+func releasePair(pool *sync.Pool, p Pair) {
+	pp, ok := p.(*pair)
+	if !ok || isEmpty(p) {
+		return
+	}
+	*pp = pair{}
+	pool.Put(pp)
+}
+
+// copyChain 会复制从head开始的整条链表并返回副本的表头。
+func copyChain(head Pair) Pair {
+	var first, last Pair
+	for v := head; v != nil; v = v.Next() {
+		c := v.Copy()
+		if last == nil {
+			first = c
+		} else {
+			last.SetNext(c)
+		}
+		last = c
+	}
+	return first
+}
@@ -13,6 +13,12 @@ const (
 
 	//BUCKET_STATUS_OVERWEIGHT 散列桶过重
 	BUCKET_STATUS_OVERWEIGHT BucketStatus = 2
+
+	//BUCKET_STATUS_OVERLOADED 散列段的键-元素对总数超过了散列桶数量与装载因子的乘积
+	BUCKET_STATUS_OVERLOADED BucketStatus = 3
+
+	//BUCKET_STATUS_OVERLONG 单个散列桶的链表长度超过了上限
+	BUCKET_STATUS_OVERLONG BucketStatus = 4
 )
 
 // 针对键 - 元素对的再分布器
@@ -28,12 +34,37 @@ type PairRedistributor interface {
 	Redistribe(bucketStatus BucketStatus, buckets []Bucket) (newBuckets []Bucket, changed bool)
 }
 
+// IncrementalRedistributor 代表只决定再分布后散列桶数量的再分布器。
+// 设置了WithIncrementalResize时，散列段会用它得到新的散列桶数量，
+// 再由自己把键-元素对逐步迁移过去，未实现它的再分布器仍然一次性再散列。
+type IncrementalRedistributor interface {
+	// 返回bucketNumber个散列桶在给定状态下再分布后的数量，changed为false代表无需再分布
+	PlanRedistribution(bucketStatus BucketStatus, bucketNumber int) (newNumber int, changed bool)
+}
+
+// BucketLocator 代表能够自行决定键散列值所属散列桶的再分布器。
+// 散列段会用它定位散列桶，未实现它的再分布器使用取模的方式。
+type BucketLocator interface {
+	// 返回键散列值在bucketNumber个散列桶中所属散列桶的索引
+	BucketIndex(keyHash uint64, bucketNumber int) int
+}
+
 //PairRedistributor 默认实现
 type myPairRedistributor struct {
 	//loadFactor 装载因子
 	loadFactor float64
+	//consistent 是否使用一致性散列定位散列桶
+	consistent bool
+	//maxChainLength 单个散列桶链表长度的上限，超过它会触发扩容
+	maxChainLength uint64
+	//bucketNumber 最近一次更新阈值时的散列桶数量
+	bucketNumber uint64
+	//newBucket 再散列时用于创建第i个散列桶的函数，为nil时使用newBucket
+	newBucket func(i int) Bucket
 	//upperThreshold 散列桶重量的上阈限，散列桶尺寸增至此会触发再散列
 	upperThreshold uint64
+	//loadThreshold 散列段装载量的上阈限，键-元素对总数超过此值会触发扩容
+	loadThreshold uint64
 	//overweightBucketCount 过重散列桶计数
 	overweightBucketCount uint64
 	//emptyBucketCount 空散列桶计数
@@ -56,6 +87,8 @@ func (m *myPairRedistributor) UpdateThreshold(pairTotal uint64, bucketNumber int
 	}
 
 	atomic.StoreUint64(&m.upperThreshold, uint64(average*m.loadFactor))
+	atomic.StoreUint64(&m.loadThreshold, uint64(float64(bucketNumber)*m.loadFactor))
+	atomic.StoreUint64(&m.bucketNumber, uint64(bucketNumber))
 }
 
 var bucketStatusTemplate = `Check bucket status: 
@@ -69,8 +102,18 @@ var bucketStatusTemplate = `Check bucket status:
 `
 
 func (m *myPairRedistributor) CheckBucketStatus(pairTotal uint64, bucketSize uint64) (bucketStatus BucketStatus) {
-	if bucketSize > DEFAULT_BUCKET_MAX_SIZE ||
-		bucketSize >= atomic.LoadUint64(&m.upperThreshold) {
+	if pairTotal > atomic.LoadUint64(&m.loadThreshold) {
+		bucketStatus = BUCKET_STATUS_OVERLOADED
+		return
+	}
+	// 散列桶已经多于键-元素对时扩容无助于缩短链表，
+	// 此时链表过长只能是因为散列值完全相同，不再继续扩容
+	if bucketSize > m.maxChainLength &&
+		atomic.LoadUint64(&m.bucketNumber) < pairTotal {
+		bucketStatus = BUCKET_STATUS_OVERLONG
+		return
+	}
+	if bucketSize >= atomic.LoadUint64(&m.upperThreshold) {
 		atomic.AddUint64(&m.overweightBucketCount, 1)
 		bucketStatus = BUCKET_STATUS_OVERWEIGHT
 		return
@@ -88,60 +131,56 @@ var redistributionTemplate = `Redistributing:
 `
 
 func (m *myPairRedistributor) Redistribe(bucketStatus BucketStatus, buckets []Bucket) (newBuckets []Bucket, changed bool) {
-	currentNumber := uint64(len(buckets))
-	newNumber := currentNumber
+	newNumber, changed := m.PlanRedistribution(bucketStatus, len(buckets))
+	if !changed {
+		return nil, false
+	}
+	return rehash(buckets, uint64(newNumber), m.BucketIndex, m.newBucket), true
+}
+
+func (m *myPairRedistributor) PlanRedistribution(bucketStatus BucketStatus, bucketNumber int) (newNumber int, changed bool) {
+	currentNumber := uint64(bucketNumber)
+	next := currentNumber
 	switch bucketStatus {
+	case BUCKET_STATUS_OVERLOADED, BUCKET_STATUS_OVERLONG:
+		next = m.grow(currentNumber)
 	case BUCKET_STATUS_OVERWEIGHT:
 		if atomic.LoadUint64(&m.overweightBucketCount)*4 < currentNumber {
-			return nil, false
+			return bucketNumber, false
 		}
-		newNumber = currentNumber << 1
+		next = m.grow(currentNumber)
 	case BUCKET_STATUS_UNDERWEIGHT:
 		if currentNumber < 100 ||
 			atomic.LoadUint64(&m.emptyBucketCount)*4 < currentNumber {
-			return nil, false
+			return bucketNumber, false
 		}
-		newNumber = currentNumber >> 1
-		if newNumber < 2 {
-			newNumber = 2
+		next = currentNumber >> 1
+		if next < 2 {
+			next = 2
 		}
 	default:
-		return nil, false
-	}
-	if newNumber == currentNumber {
-		atomic.StoreUint64(&m.overweightBucketCount, 0)
-		atomic.StoreUint64(&m.emptyBucketCount, 0)
-		return nil, false
-	}
-	var pairs []Pair
-	for _, b := range buckets {
-		for e := b.GetFirstPair(); e != nil; e = e.Next() {
-			pairs = append(pairs, e)
-		}
-	}
-	if newNumber > currentNumber {
-		for i := uint64(0); i < currentNumber; i++ {
-			buckets[i].Clear(nil)
-		}
-		for j := newNumber - currentNumber; j > 0; j-- {
-			buckets = append(buckets, newBucket())
-		}
-	} else {
-		buckets = make([]Bucket, newNumber)
-		for i := uint64(0); i < newNumber; i++ {
-			buckets[i] = newBucket()
-		}
-	}
-	var count int
-	for _, p := range pairs {
-		index := int(p.Hash() % newNumber)
-		b := buckets[index]
-		b.Put(p, nil)
-		count++
+		return bucketNumber, false
 	}
 	atomic.StoreUint64(&m.overweightBucketCount, 0)
 	atomic.StoreUint64(&m.emptyBucketCount, 0)
-	return buckets, true
+	return int(next), next != currentNumber
+}
+
+func (m *myPairRedistributor) BucketIndex(keyHash uint64, bucketNumber int) int {
+	if m.consistent {
+		return jumpIndex(keyHash, bucketNumber)
+	}
+	return moduloIndex(keyHash, bucketNumber)
+}
+
+// grow 返回扩容后的散列桶数量。
+// 取模方式下只有翻倍才能让一半的键留在原处，
+// 一致性散列下每次只增加一半，移动的键约占三分之一
+func (m *myPairRedistributor) grow(currentNumber uint64) uint64 {
+	if m.consistent {
+		return currentNumber + (currentNumber+1)>>1
+	}
+	return currentNumber << 1
 }
 
 // loadFactor 散列桶负载因子  bucketNumber 散列桶数量
@@ -151,6 +190,68 @@ func newDefaultPairRedistributor(loadFactor float64, bucketNumber int) PairRedis
 	}
 	pr := &myPairRedistributor{}
 	pr.loadFactor = loadFactor
+	pr.maxChainLength = DEFAULT_BUCKET_MAX_SIZE
 	pr.UpdateThreshold(0, bucketNumber)
 	return pr
 }
+
+// newConsistentPairRedistributor 会创建使用一致性散列定位散列桶的再分布器，
+// 散列桶数量从n变为m时只有约|m-n|/max(m,n)的键需要换到别的散列桶
+func newConsistentPairRedistributor(loadFactor float64, bucketNumber int) PairRedistributor {
+	pr := newDefaultPairRedistributor(loadFactor, bucketNumber).(*myPairRedistributor)
+	pr.consistent = true
+	return pr
+}
+
+// newPairRedistributor 会按照可选配置创建默认再分布器，
+// 再散列时用newBucket创建散列桶
+func newPairRedistributor(opts options, bucketNumber int, newBucket func(i int) Bucket) PairRedistributor {
+	var pr *myPairRedistributor
+	if opts.consistentHashing {
+		pr = newConsistentPairRedistributor(opts.loadFactor, bucketNumber).(*myPairRedistributor)
+	} else {
+		pr = newDefaultPairRedistributor(opts.loadFactor, bucketNumber).(*myPairRedistributor)
+	}
+	if opts.maxChainLength > 0 {
+		pr.maxChainLength = opts.maxChainLength
+	}
+	pr.newBucket = newBucket
+	return pr
+}
+
+// moduloIndex 以取模的方式定位散列桶
+func moduloIndex(keyHash uint64, bucketNumber int) int {
+	return int(keyHash % uint64(bucketNumber))
+}
+
+// jumpIndex 以Jump一致性散列（Lamping & Veach）定位散列桶。
+// 它不需要虚拟节点和散列环，也没有额外的内存开销
+func jumpIndex(keyHash uint64, bucketNumber int) int {
+	var b, j int64 = -1, 0
+	for j < int64(bucketNumber) {
+		b = j
+		keyHash = keyHash*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((keyHash>>33)+1)))
+	}
+	return int(b)
+}
+
+// rehash 会把键-元素对的副本按照index重新散列到newNumber个由create创建的新散列桶中，
+// create为nil时使用newBucket。
+// 旧的散列桶不会被改动，这样正在读取它们的读操作仍然能找到自己的键
+func rehash(buckets []Bucket, newNumber uint64, index func(keyHash uint64, bucketNumber int) int, create func(i int) Bucket) []Bucket {
+	newBuckets := make([]Bucket, newNumber)
+	for i := range newBuckets {
+		if create != nil {
+			newBuckets[i] = create(i)
+		} else {
+			newBuckets[i] = newBucket()
+		}
+	}
+	for _, b := range buckets {
+		for _, p := range b.Pairs() {
+			newBuckets[index(p.Hash(), int(newNumber))].Put(p.Copy(), nil)
+		}
+	}
+	return newBuckets
+}
@@ -0,0 +1,52 @@
+package concurrentMap
+
+// ReadOnlyMap 代表字典的只读视图。
+// 与Snapshot不同，它直接读取字典当前的内容，字典之后的修改都能被观察到。
+type ReadOnlyMap interface {
+	// Load 返回键对应的元素以及键是否存在
+	Load(key string) (element interface{}, ok bool)
+	// Contains 判断键是否存在，已过期的键视为不存在
+	Contains(key string) bool
+	// Range 对每个键-元素对调用f，f返回false时停止遍历
+	Range(f func(key string, element interface{}) bool)
+	// Len 返回键-元素对的数量
+	Len() uint64
+	// Keys 返回当前所有键的快照
+	Keys() []string
+	// Values 返回当前所有元素的快照
+	Values() []interface{}
+}
+
+// readOnlyMap 代表ReadOnlyMap的实现类型。
+// 它只持有ConcurrentMap而不是嵌入它，因此无法通过类型断言得到写方法
+type readOnlyMap struct {
+	cmap ConcurrentMap
+}
+
+func (cmap *myConcurrentMap) ReadOnly() ReadOnlyMap {
+	return readOnlyMap{cmap: cmap}
+}
+
+func (rom readOnlyMap) Load(key string) (element interface{}, ok bool) {
+	return rom.cmap.Load(key)
+}
+
+func (rom readOnlyMap) Contains(key string) bool {
+	return rom.cmap.Contains(key)
+}
+
+func (rom readOnlyMap) Range(f func(key string, element interface{}) bool) {
+	rom.cmap.Range(f)
+}
+
+func (rom readOnlyMap) Len() uint64 {
+	return rom.cmap.Len()
+}
+
+func (rom readOnlyMap) Keys() []string {
+	return rom.cmap.Keys()
+}
+
+func (rom readOnlyMap) Values() []interface{} {
+	return rom.cmap.Values()
+}
@@ -4,81 +4,948 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Segment interface {
 	Put(p Pair) (bool, error)
+	// PutBatch 在一次加锁内放入多个键 - 元素对并返回新增的数量
+	PutBatch(pairs []Pair) (int, error)
+	// TryPut 在能够不等待地获取锁时放入键 - 元素对，acquired为false代表锁正被占用
+	TryPut(p Pair) (acquired bool, inserted bool, err error)
+	// PutIfAbsent 仅在键不存在或已过期时放入给定的键-元素对，
+	// replaced为true代表p取代了已过期的键-元素对，此时散列段的总数不变
+	PutIfAbsent(p Pair) (ok bool, replaced bool, err error)
 	Get(key string) Pair
 	// 根据给定参数返回对应键 - 元素对
 	GetWithHash(key string, keyHash uint64) Pair
+	// GetBatch 在一次加读锁内定位多个键所属的散列桶，
+	// 返回与keys一一对应的键 - 元素对，不存在的键对应nil
+	GetBatch(keys []string) []Pair
+	// TryGetWithHash 与GetWithHash相同，但在无法不等待地获取读锁时返回acquired为false
+	TryGetWithHash(key string, keyHash uint64) (p Pair, acquired bool)
+	// Upsert 在键不存在时放入给定的键 - 元素对，
+	// 否则用resolve的结果替换已有元素
+	Upsert(p Pair, resolve func(existing, incoming interface{}) interface{}) (bool, error)
+	// GetOrPut 在键存在且未过期时返回对应键 - 元素对，
+	// 否则用newElement的结果创建新的键 - 元素对放入并返回，
+	// replaced为true代表新的键 - 元素对取代了已过期的键 - 元素对，此时散列段的总数不变
+	GetOrPut(key string, keyHash uint64, newElement func() interface{}) (actual Pair, loaded bool, replaced bool, err error)
+	// Compute 在持有锁的情况下按照f返回的操作保持、存储或删除键对应的键 - 元素对，
+	// 返回键 - 元素对数量的变化（1、0或-1）
+	Compute(key string, keyHash uint64, f func(old interface{}, exists bool) (interface{}, ComputeOp)) (int, error)
 	Delete(key string) bool
+	// DeleteWithHash 根据给定的键散列值删除对应键 - 元素对，避免重复计算散列值
+	DeleteWithHash(key string, keyHash uint64) bool
+	// DeleteBatch 在一次加锁内删除多个键并返回实际删除的数量
+	DeleteBatch(keys []string) int
+	// DeleteIf 仅在键存在且cond返回true时删除对应键 - 元素对
+	DeleteIf(key string, keyHash uint64, cond func(p Pair) bool) bool
+	// DeleteMatching 在一次加锁内删除所有使pred返回true的键 - 元素对并返回删除数量
+	DeleteMatching(pred func(p Pair) bool) int
+	// Drain 在持有锁的情况下依次把未过期的键 - 元素对传给f并删除它，
+	// f返回false时停止，返回删除的数量以及是否因f返回false而停止
+	Drain(f func(key string, element interface{}) bool) (drained int, stopped bool)
+	// DeleteExpired 删除所有在给定时刻已过期的键 - 元素对并返回删除数量
+	DeleteExpired(now int64) uint64
+	// Compact 在键 - 元素对总数远小于散列桶数量时收缩散列桶，返回是否发生了收缩
+	Compact() bool
+	// Reserve 在散列桶不足以按装载因子容纳pairTotal个键 - 元素对时预先扩容，返回是否发生了扩容
+	Reserve(pairTotal uint64) bool
+	// Clear 清空散列段并返回被清除的键 - 元素对数量
+	Clear() uint64
 	Size() uint64
+	// Range 依次把散列段中的每个键-元素对传给f，
+	// f返回false时停止遍历，返回值表示是否完整遍历
+	Range(f func(p Pair) bool) bool
+	// Buckets 返回散列段当前散列桶列表的快照
+	Buckets() []Bucket
+	// BeginRead 标记一次无锁读操作的开始，
+	// 在EndRead之前读到的键 - 元素对不会被回收复用
+	BeginRead()
+	// EndRead 标记一次无锁读操作的结束
+	EndRead()
+	// CopyPairs 在持有锁的情况下返回散列段中所有键 - 元素对的副本
+	CopyPairs() []Pair
+	// Snapshot 在持有锁的情况下记录散列段当前所有散列桶的表头
+	Snapshot() segmentSnapshot
+	// Lock 获取散列段的写锁，持有期间只能调用带有Locked后缀的方法
+	Lock()
+	// Unlock 释放写锁，并执行持有锁期间积累的通知与回调
+	Unlock()
+	// GetLocked 在调用方已持有写锁时返回键对应的键 - 元素对
+	GetLocked(key string, keyHash uint64) Pair
+	// PutLocked 在调用方已持有写锁时放入键 - 元素对
+	PutLocked(p Pair) (bool, error)
+	// CheckInvariants 在持有写锁时检查散列段内部状态的一致性
+	CheckInvariants() error
+	// DeleteLocked 在调用方已持有写锁时删除键对应的键 - 元素对
+	DeleteLocked(key string, keyHash uint64) bool
+	// RangeLocked 在调用方已持有写锁时依次把每个键 - 元素对传给f，f返回false时停止遍历
+	RangeLocked(f func(p Pair) bool)
+	// ResetLocked 在调用方已持有写锁时换上同样数量的空散列桶，并返回原有的全部键 - 元素对
+	ResetLocked() []Pair
+	// BucketIndex 返回键散列值在散列段中所属散列桶的索引
+	BucketIndex(keyHash uint64) int
+	// BucketSizes 返回散列段中每个散列桶的尺寸
+	BucketSizes() []uint64
 }
 
+// ComputeOp 代表Compute的回调要求执行的操作。
+type ComputeOp uint8
+
+const (
+	//COMPUTE_OP_KEEP 保持键 - 元素对不变
+	COMPUTE_OP_KEEP ComputeOp = 0
+
+	//COMPUTE_OP_STORE 存储回调返回的元素，键不存在时会插入
+	COMPUTE_OP_STORE ComputeOp = 1
+
+	//COMPUTE_OP_DELETE 删除键对应的键 - 元素对
+	COMPUTE_OP_DELETE ComputeOp = 2
+)
+
 type segment struct {
 	buckets           []Bucket
 	bucketsLen        int
 	pairTotal         uint64
 	pairRedistributor PairRedistributor
-	lock              sync.Mutex
+	lock              segmentLock
+	// 计算键散列值的函数
+	hashFunc func(key string) uint64
+	// 定位散列桶的函数
+	bucketIndex func(keyHash uint64, bucketNumber int) int
+	// 创建第i个散列桶的函数
+	newBucket func(i int) Bucket
+	// 收缩时散列桶数量的下限
+	minBucketNumber int
+	// 收缩时使用的装载因子
+	loadFactor float64
+	// 键 - 元素对被写入或移除时的监听器，可以为nil
+	listener pairListener
+	// 操作的观察者，可以为nil
+	observer Observer
+	// 持有锁期间发生的、尚未通知观察者的再散列，每项为新旧散列桶数量
+	pendingResizes [][2]int
+	// 键 - 元素对离开散列段时的回调，可以为nil
+	onEvict func(key string, element interface{})
+	// 持有锁期间离开散列段、尚未回调的键 - 元素对
+	pendingEvictions []evictedPair
+	// 复用键 - 元素对的池，可以为nil
+	pairPool *sync.Pool
+	// 正在进行的无锁读操作的数量，只在pairPool不为nil时维护
+	readers int64
+	// 已被移除、等待没有读操作时放回池中的键 - 元素对
+	retired []Pair
+	// 判断键 - 元素对是否过期时使用的时钟
+	clock func() time.Time
+	// 最近一次分配的版本号，只在持有写锁时访问。
+	// 它只增不减，因此同一个键即使被删除后再放入也不会得到重复的版本号
+	version uint64
+	// 渐进式再散列时每次写操作顺带迁移的旧散列桶数量，0代表一次性再散列
+	migrateStep int
+	// 渐进式再散列期间的旧散列桶，为nil代表没有正在进行的迁移
+	oldBuckets []Bucket
+	// 旧散列桶是否已经迁移
+	migrated []bool
+	// 下一个按顺序迁移的旧散列桶的索引
+	migrateCursor int
+	// 尚未迁移的旧散列桶数量
+	unmigrated int
+	// 读取命中时是否把键 - 元素对移到所在链表的表头
+	moveToFront bool
+}
+
+// evictedPair 代表离开散列段的键和元素。
+type evictedPair struct {
+	key     string
+	element interface{}
+}
+
+// pairListener 代表散列段中键 - 元素对的监听器，
+// 它的方法总是在持有散列段锁的情况下被调用。
+type pairListener interface {
+	// pairStored 会在键对应的元素被放入或覆盖后被调用
+	pairStored(key string, element interface{})
+	// pairRemoved 会在键对应的键 - 元素对被移除后被调用
+	pairRemoved(key string)
+}
+
+// segmentLock 代表散列段使用的锁，只读操作会使用读锁。
+type segmentLock interface {
+	sync.Locker
+	RLock()
+	RUnlock()
+	TryLock() bool
+	TryRLock() bool
+}
+
+// mutexLock 代表基于互斥锁的segmentLock，它的读锁与写锁相同。
+type mutexLock struct {
+	sync.Mutex
+}
+
+func (l *mutexLock) RLock() {
+	l.Lock()
+}
+
+func (l *mutexLock) RUnlock() {
+	l.Unlock()
+}
+
+func (l *mutexLock) TryRLock() bool {
+	return l.TryLock()
 }
 
-func newSegment(bucketNumber int, pairRedistributor PairRedistributor) Segment {
-	if bucketNumber < 0 {
+func newSegment(bucketNumber int, pairRedistributor PairRedistributor, opts options, listener pairListener) Segment {
+	if bucketNumber <= 0 {
 		bucketNumber = DEFAULT_BUCKET_NUMBER
 	}
+	lockFor := func(i int) *sync.Mutex {
+		return &sync.Mutex{}
+	}
+	if opts.lockStripes > 0 {
+		stripes := make([]sync.Mutex, opts.lockStripes)
+		lockFor = func(i int) *sync.Mutex {
+			return &stripes[i%len(stripes)]
+		}
+	}
+	create := func(i int) Bucket {
+		return newBucketWithClock(lockFor(i), opts.keyEquals, opts.clock)
+	}
 	if pairRedistributor == nil {
-		pairRedistributor = nil //todo default pair redistributor
+		pairRedistributor = newPairRedistributor(opts, bucketNumber, create)
+	}
+	bucketIndex := moduloIndex
+	if locator, ok := pairRedistributor.(BucketLocator); ok {
+		bucketIndex = locator.BucketIndex
 	}
 	buckets := make([]Bucket, bucketNumber)
 	for i := 0; i < bucketNumber; i++ {
-		buckets[i] = nil //todo bucket entity
+		buckets[i] = create(i)
+	}
+	var lock segmentLock = &mutexLock{}
+	if opts.rwLock {
+		lock = &sync.RWMutex{}
 	}
 	return &segment{
+		lock:              lock,
 		buckets:           buckets,
 		bucketsLen:        bucketNumber,
 		pairRedistributor: pairRedistributor,
+		hashFunc:          opts.hashFunc,
+		bucketIndex:       bucketIndex,
+		newBucket:         create,
+		minBucketNumber:   bucketNumber,
+		loadFactor:        opts.loadFactor,
+		listener:          listener,
+		observer:          opts.observer,
+		onEvict:           opts.onEvict,
+		pairPool:          opts.pairPool,
+		migrateStep:       opts.migrateStep,
+		clock:             opts.clock,
+		moveToFront:       opts.moveToFront,
 	}
 }
 
 func (s *segment) Put(p Pair) (bool, error) {
 	s.lock.Lock()
-	b := s.buckets[int(p.Hash()%uint64(s.bucketsLen))]
-	ok, err := b.Put(p, nil)
-	if ok {
-		newTotal := atomic.AddUint64(&s.pairTotal, 1)
-		s.redistribute(newTotal, b.Size())
-	}
-	s.lock.Unlock()
+	b := s.bucketFor(p.Hash())
+	ok, err := s.putInto(b, p)
+	s.unlock()
 	return ok, err
 }
 
+func (s *segment) PutBatch(pairs []Pair) (int, error) {
+	s.lock.Lock()
+	defer s.unlock()
+	var inserted int
+	for _, p := range pairs {
+		b := s.bucketFor(p.Hash())
+		ok, err := s.putInto(b, p)
+		if err != nil {
+			return inserted, err
+		}
+		if ok {
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func (s *segment) TryPut(p Pair) (acquired bool, inserted bool, err error) {
+	if !s.lock.TryLock() {
+		return false, false, nil
+	}
+	b := s.bucketFor(p.Hash())
+	inserted, err = s.putInto(b, p)
+	s.unlock()
+	return true, inserted, err
+}
+
+func (s *segment) PutIfAbsent(p Pair) (ok bool, replaced bool, err error) {
+	s.lock.Lock()
+	defer s.unlock()
+	b := s.bucketFor(p.Hash())
+	existing := b.Get(p.Key())
+	size := b.Size()
+	s.stamp(p)
+	if ok, err = b.PutIfAbsent(p, nil); !ok {
+		return false, false, err
+	}
+	if b.Size() > size {
+		s.added(b, p)
+		return true, false, nil
+	}
+	s.expiredReplaced(existing, p)
+	return true, true, nil
+}
+
+func (s *segment) Upsert(p Pair, resolve func(existing, incoming interface{}) interface{}) (bool, error) {
+	s.lock.Lock()
+	defer s.unlock()
+	b := s.bucketFor(p.Hash())
+	if existing := b.Get(p.Key()); existing != nil {
+		np, err := newPairWithHash(p.Key(), p.Hash(), resolve(existing.Element(), p.Element()))
+		if err != nil {
+			return false, err
+		}
+		inheritExpiration(np, existing)
+		inheritRawKey(np, p)
+		p = np
+	}
+	return s.putInto(b, p)
+}
+
 func (s *segment) Get(key string) Pair {
-	return s.GetWithHash(key, hash(key))
+	return s.GetWithHash(key, s.hashFunc(key))
 }
 
 func (s *segment) GetWithHash(key string, keyHash uint64) Pair {
+	s.lock.RLock()
+	b := s.readBucket(keyHash)
+	s.lock.RUnlock()
+	p := b.Get(key)
+	if p != nil && s.moveToFront {
+		if moved := b.MoveToFront(p); moved != nil {
+			p = moved
+		}
+	}
+	return p
+}
+
+func (s *segment) GetBatch(keys []string) []Pair {
+	buckets := make([]Bucket, len(keys))
+	s.lock.RLock()
+	for i, key := range keys {
+		buckets[i] = s.readBucket(s.hashFunc(key))
+	}
+	s.lock.RUnlock()
+	pairs := make([]Pair, len(keys))
+	for i, b := range buckets {
+		pairs[i] = b.Get(keys[i])
+	}
+	return pairs
+}
+
+func (s *segment) TryGetWithHash(key string, keyHash uint64) (p Pair, acquired bool) {
+	if !s.lock.TryRLock() {
+		return nil, false
+	}
+	b := s.readBucket(keyHash)
+	s.lock.RUnlock()
+	return b.Get(key), true
+}
+
+func (s *segment) GetOrPut(key string, keyHash uint64, newElement func() interface{}) (actual Pair, loaded bool, replaced bool, err error) {
 	s.lock.Lock()
-	b := s.buckets[int(keyHash%uint64(s.bucketsLen))]
-	s.lock.Unlock()
-	return b.Get(key)
+	defer s.unlock()
+	b := s.bucketFor(keyHash)
+	existing := b.Get(key)
+	if existing != nil && !isExpired(existing, s.now()) {
+		return existing, true, false, nil
+	}
+	p, err := newPairWithHash(key, keyHash, newElement())
+	if err != nil {
+		return nil, false, false, err
+	}
+	s.stamp(p)
+	if _, err = b.Put(p, nil); err != nil {
+		return nil, false, false, err
+	}
+	if existing == nil {
+		s.added(b, p)
+		return p, false, false, nil
+	}
+	s.expiredReplaced(existing, p)
+	return p, false, true, nil
+}
+
+func (s *segment) Compute(key string, keyHash uint64, f func(old interface{}, exists bool) (interface{}, ComputeOp)) (int, error) {
+	s.lock.Lock()
+	defer s.unlock()
+	b := s.bucketFor(keyHash)
+	p := b.Get(key)
+	expired := p != nil && isExpired(p, s.now())
+	var old interface{}
+	exists := p != nil && !expired
+	if exists {
+		old = p.Element()
+	}
+	newElement, op := f(old, exists)
+	switch op {
+	case COMPUTE_OP_STORE:
+	case COMPUTE_OP_DELETE:
+		if p == nil || !s.deleteFrom(b, key) {
+			return 0, nil
+		}
+		return -1, nil
+	default:
+		return 0, nil
+	}
+	np, err := newPairWithHash(key, keyHash, newElement)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		inheritExpiration(np, p)
+		inheritRawKey(np, p)
+	}
+	inserted, err := s.putInto(b, np)
+	if err != nil || !inserted {
+		return 0, err
+	}
+	return 1, nil
 }
 
 func (s *segment) Delete(key string) bool {
+	return s.DeleteWithHash(key, s.hashFunc(key))
+}
+
+func (s *segment) DeleteWithHash(key string, keyHash uint64) bool {
 	s.lock.Lock()
-	b := s.buckets[int(hash(key)%uint64(s.bucketsLen))]
-	ok := b.Delete(key, nil)
-	if ok {
-		newTotal := atomic.AddUint64(&s.pairTotal, ^uint64(0))
-		s.redistribute(newTotal, b.Size())
+	b := s.bucketFor(keyHash)
+	ok := s.deleteFrom(b, key)
+	s.unlock()
+	return ok
+}
+
+func (s *segment) DeleteBatch(keys []string) int {
+	s.lock.Lock()
+	defer s.unlock()
+	var deleted int
+	for _, key := range keys {
+		b := s.bucketFor(s.hashFunc(key))
+		if s.deleteFrom(b, key) {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (s *segment) DeleteIf(key string, keyHash uint64, cond func(p Pair) bool) bool {
+	s.lock.Lock()
+	defer s.unlock()
+	b := s.bucketFor(keyHash)
+	p := b.Get(key)
+	if p == nil || !cond(p) {
+		return false
+	}
+	return s.deleteFrom(b, key)
+}
+
+func (s *segment) DeleteMatching(pred func(p Pair) bool) int {
+	s.lock.Lock()
+	defer s.unlock()
+	var matched []Pair
+	for _, b := range s.liveBuckets() {
+		for _, p := range b.Pairs() {
+			if pred(p) {
+				matched = append(matched, p)
+			}
+		}
+	}
+	// 删除可能引发再散列，因此每次都要重新定位散列桶
+	var count int
+	for _, p := range matched {
+		b := s.bucketFor(p.Hash())
+		if s.deleteFrom(b, p.Key()) {
+			count++
+		}
 	}
+	return count
+}
+
+func (s *segment) Drain(f func(key string, element interface{}) bool) (drained int, stopped bool) {
+	s.lock.Lock()
+	defer s.unlock()
+	var pairs []Pair
+	for _, b := range s.liveBuckets() {
+		pairs = append(pairs, b.Pairs()...)
+	}
+	now := s.now()
+	for _, p := range pairs {
+		if isExpired(p, now) {
+			continue
+		}
+		more := f(p.Key(), p.Element())
+		// 删除可能引发再散列，因此每次都要重新定位散列桶
+		if s.deleteFrom(s.bucketFor(p.Hash()), p.Key()) {
+			drained++
+		}
+		if !more {
+			return drained, true
+		}
+	}
+	return drained, false
+}
+
+func (s *segment) DeleteExpired(now int64) uint64 {
+	return uint64(s.DeleteMatching(func(p Pair) bool {
+		return isExpired(p, now)
+	}))
+}
+
+func (s *segment) Compact() bool {
+	s.lock.Lock()
+	defer s.unlock()
+	s.finishMigration()
+	pairTotal := atomic.LoadUint64(&s.pairTotal)
+	if float64(pairTotal) >= float64(s.bucketsLen)*DEFAULT_COMPACT_WATERMARK {
+		return false
+	}
+	newNumber := s.minBucketNumber
+	for float64(pairTotal) > float64(newNumber)*s.loadFactor {
+		newNumber <<= 1
+	}
+	if newNumber >= s.bucketsLen {
+		return false
+	}
+	s.resize(pairTotal, newNumber)
+	return true
+}
+
+func (s *segment) Reserve(pairTotal uint64) bool {
+	s.lock.Lock()
+	defer s.unlock()
+	s.finishMigration()
+	newNumber := s.bucketsLen
+	for float64(pairTotal) > float64(newNumber)*s.loadFactor {
+		newNumber <<= 1
+	}
+	if newNumber == s.bucketsLen {
+		return false
+	}
+	s.resize(atomic.LoadUint64(&s.pairTotal), newNumber)
+	return true
+}
+
+// resize 在持有锁的情况下把散列桶重新散列为newNumber个
+func (s *segment) resize(pairTotal uint64, newNumber int) {
+	if s.observer != nil {
+		s.pendingResizes = append(s.pendingResizes, [2]int{s.bucketsLen, newNumber})
+	}
+	s.buckets = rehash(s.buckets, uint64(newNumber), s.bucketIndex, s.newBucket)
+	s.bucketsLen = newNumber
+	s.pairRedistributor.UpdateThreshold(pairTotal, newNumber)
+}
+
+func (s *segment) Clear() uint64 {
+	s.lock.Lock()
+	defer s.unlock()
+	for _, b := range s.liveBuckets() {
+		if s.listener != nil || s.onEvict != nil {
+			for _, p := range b.Pairs() {
+				s.removed(p.Key(), p.Element())
+			}
+		}
+		b.Clear(nil)
+	}
+	// 未迁移的旧散列桶已被清空，迁移也就无需继续
+	s.oldBuckets, s.migrated, s.migrateCursor, s.unmigrated = nil, nil, 0, 0
+	return atomic.SwapUint64(&s.pairTotal, 0)
+}
+
+// unlock 会释放写锁，然后把持有锁期间发生的再散列通知给观察者，
+// 并按发生的顺序对离开散列段的键 - 元素对调用回调
+func (s *segment) unlock() {
+	resizes := s.pendingResizes
+	s.pendingResizes = nil
+	evictions := s.pendingEvictions
+	s.pendingEvictions = nil
 	s.lock.Unlock()
-	return ok
+	for _, resize := range resizes {
+		s.observer.OnResize(resize[0], resize[1])
+	}
+	for _, e := range evictions {
+		s.onEvict(e.key, e.element)
+	}
+}
+
+// evicted 在持有锁的情况下记录一个离开散列段的元素，它会在释放锁之后被回调
+func (s *segment) evicted(key string, element interface{}) {
+	if s.onEvict != nil {
+		s.pendingEvictions = append(s.pendingEvictions, evictedPair{key: key, element: element})
+	}
+}
+
+// now 返回散列段的时钟给出的当前时刻（Unix纳秒）
+func (s *segment) now() int64 {
+	return s.clock().UnixNano()
+}
+
+// stamp 在持有锁的情况下为即将放入的键 - 元素对分配版本号。
+// p已经带有版本号（例如从其他字典复制或解码而来）时保留它，并让之后分配的版本号大于它
+func (s *segment) stamp(p Pair) {
+	pp, ok := p.(*pair)
+	if !ok {
+		return
+	}
+	if pp.version == 0 {
+		s.version++
+		pp.version = s.version
+	} else if pp.version > s.version {
+		s.version = pp.version
+	}
+}
+
+// putInto 在持有锁的情况下把键 - 元素对放入散列桶b
+func (s *segment) putInto(b Bucket, p Pair) (bool, error) {
+	s.stamp(p)
+	var existing Pair
+	if s.onEvict != nil || s.pairPool != nil {
+		existing = b.Get(p.Key())
+	}
+	ok, err := b.Put(p, nil)
+	if err != nil {
+		return false, err
+	}
+	if !ok && existing != nil {
+		s.evicted(p.Key(), existing.Element())
+		s.retire(existing)
+	}
+	if ok {
+		s.added(b, p)
+	} else {
+		s.stored(p.Key(), p.Element())
+	}
+	return ok, nil
+}
+
+// bucketFor 返回键散列值所属的散列桶，调用方需要持有写锁。
+// 渐进式再散列期间，它会先迁移键所在的旧散列桶，再顺带迁移migrateStep个旧散列桶，
+// 因此写操作总是作用于新的散列桶
+func (s *segment) bucketFor(keyHash uint64) Bucket {
+	if s.oldBuckets != nil {
+		s.migrateBucket(s.bucketIndex(keyHash, len(s.oldBuckets)))
+		s.migrateSome(s.migrateStep)
+	}
+	return s.buckets[s.bucketIndex(keyHash, s.bucketsLen)]
+}
+
+// readBucket 返回键散列值当前所在的散列桶，调用方需要持有读锁或写锁。
+// 渐进式再散列期间，尚未迁移的键仍然位于旧散列桶中
+func (s *segment) readBucket(keyHash uint64) Bucket {
+	if s.oldBuckets != nil {
+		if i := s.bucketIndex(keyHash, len(s.oldBuckets)); !s.migrated[i] {
+			return s.oldBuckets[i]
+		}
+	}
+	return s.buckets[s.bucketIndex(keyHash, s.bucketsLen)]
+}
+
+// liveBuckets 返回当前保存着键 - 元素对的全部散列桶，调用方需要持有读锁或写锁。
+// 渐进式再散列期间，它们是新的散列桶加上按索引排列的尚未迁移的旧散列桶
+func (s *segment) liveBuckets() []Bucket {
+	if s.oldBuckets == nil {
+		return s.buckets
+	}
+	buckets := make([]Bucket, len(s.buckets), len(s.buckets)+s.unmigrated)
+	copy(buckets, s.buckets)
+	for i, b := range s.oldBuckets {
+		if !s.migrated[i] {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// locator 返回一个函数，它给出键散列值所在散列桶在liveBuckets结果中的索引，
+// 调用方需要持有读锁或写锁，返回的函数之后不再依赖散列段的状态
+func (s *segment) locator() func(keyHash uint64) int {
+	bucketIndex, bucketNumber := s.bucketIndex, s.bucketsLen
+	if s.oldBuckets == nil {
+		return func(keyHash uint64) int {
+			return bucketIndex(keyHash, bucketNumber)
+		}
+	}
+	positions := make([]int, len(s.oldBuckets))
+	next := bucketNumber
+	for i := range s.oldBuckets {
+		positions[i] = -1
+		if !s.migrated[i] {
+			positions[i] = next
+			next++
+		}
+	}
+	return func(keyHash uint64) int {
+		if position := positions[bucketIndex(keyHash, len(positions))]; position >= 0 {
+			return position
+		}
+		return bucketIndex(keyHash, bucketNumber)
+	}
+}
+
+// startMigration 在持有锁的情况下开始把键 - 元素对渐进地迁移到newNumber个新散列桶中。
+// 旧散列桶不会被改动，正在读取它们的读操作仍然能找到自己的键
+func (s *segment) startMigration(newNumber int) {
+	if s.observer != nil {
+		s.pendingResizes = append(s.pendingResizes, [2]int{s.bucketsLen, newNumber})
+	}
+	s.oldBuckets = s.buckets
+	s.migrated = make([]bool, len(s.oldBuckets))
+	s.migrateCursor = 0
+	s.unmigrated = len(s.oldBuckets)
+	s.buckets = make([]Bucket, newNumber)
+	for i := range s.buckets {
+		s.buckets[i] = s.newBucket(i)
+	}
+	s.bucketsLen = newNumber
+}
+
+// migrateBucket 在持有锁的情况下把第i个旧散列桶中键 - 元素对的副本放入新散列桶，
+// 全部旧散列桶迁移完毕时结束迁移
+func (s *segment) migrateBucket(i int) {
+	if s.migrated[i] {
+		return
+	}
+	for _, p := range s.oldBuckets[i].Pairs() {
+		s.buckets[s.bucketIndex(p.Hash(), s.bucketsLen)].Put(p.Copy(), nil)
+	}
+	s.migrated[i] = true
+	s.unmigrated--
+	if s.unmigrated == 0 {
+		s.oldBuckets, s.migrated, s.migrateCursor = nil, nil, 0
+	}
+}
+
+// migrateSome 在持有锁的情况下按索引顺序最多迁移n个尚未迁移的旧散列桶
+func (s *segment) migrateSome(n int) {
+	for n > 0 && s.oldBuckets != nil {
+		i := s.migrateCursor
+		s.migrateCursor++
+		if !s.migrated[i] {
+			s.migrateBucket(i)
+			n--
+		}
+	}
+}
+
+// finishMigration 在持有锁的情况下迁移全部剩余的旧散列桶
+func (s *segment) finishMigration() {
+	if s.oldBuckets != nil {
+		s.migrateSome(len(s.oldBuckets))
+	}
+}
+
+// added 在持有锁的情况下记录散列桶b中新增了键 - 元素对p
+func (s *segment) added(b Bucket, p Pair) {
+	s.stored(p.Key(), p.Element())
+	newTotal := atomic.AddUint64(&s.pairTotal, 1)
+	s.redistribute(newTotal, b.Size())
+}
+
+// expiredReplaced 在持有锁的情况下记录已过期的existing被p取代。
+// 对监听器和回调而言它等同于先移除existing再新增p，但散列段的总数不变
+func (s *segment) expiredReplaced(existing, p Pair) {
+	s.removed(existing.Key(), existing.Element())
+	s.retire(existing)
+	s.stored(p.Key(), p.Element())
+}
+
+// removed 在持有锁的情况下通知监听器并记录回调键对应的键 - 元素对被移除
+func (s *segment) removed(key string, element interface{}) {
+	if s.listener != nil {
+		s.listener.pairRemoved(key)
+	}
+	s.evicted(key, element)
+}
+
+// stored 在持有锁的情况下通知监听器键对应的元素被写入
+func (s *segment) stored(key string, element interface{}) {
+	if s.listener != nil {
+		s.listener.pairStored(key, element)
+	}
 }
+
+// deleteFrom 在持有锁的情况下从散列桶b中删除键对应的键 - 元素对
+func (s *segment) deleteFrom(b Bucket, key string) bool {
+	var p Pair
+	if s.onEvict != nil || s.pairPool != nil {
+		p = b.Get(key)
+	}
+	if !b.Delete(key, nil) {
+		return false
+	}
+	var element interface{}
+	if p != nil {
+		element = p.Element()
+	}
+	s.removed(key, element)
+	s.retire(p)
+	newTotal := atomic.AddUint64(&s.pairTotal, ^uint64(0))
+	s.redistribute(newTotal, b.Size())
+	return true
+}
+
 func (s *segment) Size() uint64 {
 	return atomic.LoadUint64(&s.pairTotal)
 }
 
+func (s *segment) Range(f func(p Pair) bool) bool {
+	s.BeginRead()
+	defer s.EndRead()
+	for _, b := range s.Buckets() {
+		for _, p := range b.Pairs() {
+			if !f(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *segment) Buckets() []Bucket {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.liveBuckets()
+}
+
+func (s *segment) CopyPairs() []Pair {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pairs := make([]Pair, 0, atomic.LoadUint64(&s.pairTotal))
+	for _, b := range s.liveBuckets() {
+		for _, p := range b.Pairs() {
+			pairs = append(pairs, p.Copy())
+		}
+	}
+	return pairs
+}
+
+func (s *segment) Snapshot() segmentSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	buckets := s.liveBuckets()
+	heads := make([]Pair, len(buckets))
+	for i, b := range buckets {
+		if s.pairPool != nil {
+			heads[i] = copyChain(b.GetFirstPair())
+		} else {
+			heads[i] = b.GetFirstPair()
+		}
+	}
+	return segmentSnapshot{
+		heads:  heads,
+		locate: s.locator(),
+		size:   atomic.LoadUint64(&s.pairTotal),
+	}
+}
+
+func (s *segment) BeginRead() {
+	if s.pairPool != nil {
+		atomic.AddInt64(&s.readers, 1)
+	}
+}
+
+func (s *segment) EndRead() {
+	if s.pairPool != nil {
+		atomic.AddInt64(&s.readers, -1)
+	}
+}
+
+// retire 在持有锁的情况下记录一个已从散列桶中移除的键 - 元素对。
+// 没有无锁读操作时，已记录的键 - 元素对都不可能再被访问到，可以放回池中；
+// 否则它们会等到下一次没有读操作时，积压过多时则直接交给垃圾回收
+func (s *segment) retire(p Pair) {
+	if s.pairPool == nil || p == nil {
+		return
+	}
+	s.retired = append(s.retired, p)
+	if atomic.LoadInt64(&s.readers) == 0 {
+		for _, rp := range s.retired {
+			releasePair(s.pairPool, rp)
+		}
+		s.retired = s.retired[:0]
+	} else if len(s.retired) >= maxRetiredPairs {
+		s.retired = nil
+	}
+}
+
+func (s *segment) Lock() {
+	s.lock.Lock()
+}
+
+func (s *segment) Unlock() {
+	s.unlock()
+}
+
+func (s *segment) GetLocked(key string, keyHash uint64) Pair {
+	return s.bucketFor(keyHash).Get(key)
+}
+
+func (s *segment) PutLocked(p Pair) (bool, error) {
+	return s.putInto(s.bucketFor(p.Hash()), p)
+}
+
+func (s *segment) DeleteLocked(key string, keyHash uint64) bool {
+	return s.deleteFrom(s.bucketFor(keyHash), key)
+}
+
+func (s *segment) RangeLocked(f func(p Pair) bool) {
+	for _, b := range s.liveBuckets() {
+		for _, p := range b.Pairs() {
+			if !f(p) {
+				return
+			}
+		}
+	}
+}
+
+func (s *segment) ResetLocked() []Pair {
+	var pairs []Pair
+	for _, b := range s.liveBuckets() {
+		for _, p := range b.Pairs() {
+			s.removed(p.Key(), p.Element())
+			pairs = append(pairs, p)
+		}
+	}
+	buckets := make([]Bucket, s.bucketsLen)
+	for i := range buckets {
+		buckets[i] = s.newBucket(i)
+	}
+	s.buckets = buckets
+	s.oldBuckets, s.migrated, s.migrateCursor, s.unmigrated = nil, nil, 0, 0
+	atomic.StoreUint64(&s.pairTotal, 0)
+	s.pairRedistributor.UpdateThreshold(0, s.bucketsLen)
+	return pairs
+}
+
+func (s *segment) BucketIndex(keyHash uint64) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.locator()(keyHash)
+}
+
+func (s *segment) BucketSizes() []uint64 {
+	buckets := s.Buckets()
+	sizes := make([]uint64, len(buckets))
+	for i, b := range buckets {
+		sizes[i] = b.Size()
+	}
+	return sizes
+}
+
 func (s *segment) redistribute(pairTotal uint64, bucketSize uint64) (err error) {
 	defer func() {
 		if p := recover(); p != nil {
@@ -91,8 +958,20 @@ func (s *segment) redistribute(pairTotal uint64, bucketSize uint64) (err error)
 	}()
 	s.pairRedistributor.UpdateThreshold(pairTotal, s.bucketsLen)
 	bucketStatus := s.pairRedistributor.CheckBucketStatus(pairTotal, bucketSize)
+	if planner, ok := s.pairRedistributor.(IncrementalRedistributor); ok && s.migrateStep > 0 {
+		// 上一次迁移完成之前不会开始新的迁移
+		if s.oldBuckets == nil {
+			if newNumber, changed := planner.PlanRedistribution(bucketStatus, s.bucketsLen); changed {
+				s.startMigration(newNumber)
+			}
+		}
+		return nil
+	}
 	newBuckets, changed := s.pairRedistributor.Redistribe(bucketStatus, s.buckets)
 	if changed {
+		if s.observer != nil {
+			s.pendingResizes = append(s.pendingResizes, [2]int{s.bucketsLen, len(newBuckets)})
+		}
 		s.buckets = newBuckets
 		s.bucketsLen = len(newBuckets)
 	}
@@ -0,0 +1,88 @@
+package concurrentMap
+
+// Snapshot 代表字典在某一时刻的只读视图。
+type Snapshot interface {
+	// Get 返回快照中键对应的元素，不存在时返回nil
+	Get(key string) interface{}
+	// Load 返回快照中键对应的元素以及键是否存在
+	Load(key string) (element interface{}, ok bool)
+	// Range 依次把快照中的每个键-元素对传给f，f返回false时停止遍历
+	Range(f func(key string, element interface{}) bool)
+	// Len 返回快照中键-元素对的数量，与字典的Len一样包含尚未被清理的过期键-元素对
+	Len() uint64
+}
+
+// segmentSnapshot 代表散列段的快照。
+// 散列桶的链表是写时复制的，因此只需记录表头就能保留当时的全部内容
+type segmentSnapshot struct {
+	heads []Pair
+	// 返回键散列值所在散列桶在heads中的索引
+	locate func(keyHash uint64) int
+	size   uint64
+}
+
+// mapSnapshot 代表Snapshot的实现类型。
+type mapSnapshot struct {
+	cmap     *myConcurrentMap
+	segments []segmentSnapshot
+	// 创建快照的时刻，快照以它判断键-元素对是否过期
+	now int64
+}
+
+// Snapshot 会逐个散列段记录表头，每个散列段的快照都对应一个确定的时刻，
+// 不同散列段的时刻可能略有先后
+func (cmap *myConcurrentMap) Snapshot() Snapshot {
+	segments := make([]segmentSnapshot, len(cmap.segments))
+	for i, s := range cmap.segments {
+		segments[i] = s.Snapshot()
+	}
+	return &mapSnapshot{
+		cmap:     cmap,
+		segments: segments,
+		now:      cmap.now(),
+	}
+}
+
+func (snap *mapSnapshot) Get(key string) interface{} {
+	element, _ := snap.Load(key)
+	return element
+}
+
+func (snap *mapSnapshot) Load(key string) (element interface{}, ok bool) {
+	key = snap.cmap.normalize(key)
+	keyHash := snap.cmap.opts.hashFunc(key)
+	s := snap.segments[snap.cmap.segmentIndex(keyHash)]
+	for v := s.heads[s.locate(keyHash)]; v != nil; v = v.Next() {
+		if !keysEqual(snap.cmap.opts.keyEquals, v.Key(), key) {
+			continue
+		}
+		if isExpired(v, snap.now) {
+			return nil, false
+		}
+		return v.Element(), true
+	}
+	return nil, false
+}
+
+func (snap *mapSnapshot) Range(f func(key string, element interface{}) bool) {
+	for _, s := range snap.segments {
+		for _, head := range s.heads {
+			for v := head; v != nil; v = v.Next() {
+				if isExpired(v, snap.now) {
+					continue
+				}
+				if !f(displayKey(v), v.Element()) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (snap *mapSnapshot) Len() uint64 {
+	var total uint64
+	for _, s := range snap.segments {
+		total += s.size
+	}
+	return total
+}
@@ -0,0 +1,135 @@
+package concurrentMap
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Stats 代表字典的累计操作次数。
+// 带条件的写入和删除只在条件满足时计数；Clone、Filter、MapValues等创建的新字典的计数从零开始，
+// 复制进新字典的键-元素对也不计入。
+type Stats struct {
+	// Puts 写入键-元素对的次数，包括Put、PutWithTTL、TryPut、Rename、Update、Transaction、Merge、
+	// Swap、Increment、Append和存储了新元素的Compute，以及真正放入了元素的PutIfAbsent、PutIfVersion、
+	// GetOrPut、Replace和CompareAndSwap，BatchPut和PutAll按其中的每个键-元素对计数
+	Puts uint64
+	// Gets 读取键的次数，等于Hits与Misses之和。GetOrPut也算作一次读取，找到已有元素时计为命中
+	Gets uint64
+	// Hits 读取时键存在的次数
+	Hits uint64
+	// Misses 读取时键不存在的次数
+	Misses uint64
+	// Deletes 删除键的次数，包括Delete、LoadAndDelete、Rename、Transaction、删除了键的Compute
+	// 以及真正删除了键的CompareAndDelete，BatchDelete按其中的每个键计数；
+	// DeletePrefix、DeleteWhere、Drain、DrainAll和Clear按实际移除的键-元素对计数
+	Deletes uint64
+}
+
+// opStats 代表以原子操作维护的累计操作次数，更新它不需要持有任何锁。
+type opStats struct {
+	puts    uint64
+	hits    uint64
+	misses  uint64
+	deletes uint64
+}
+
+func (cmap *myConcurrentMap) Stats() Stats {
+	hits := atomic.LoadUint64(&cmap.stats.hits)
+	misses := atomic.LoadUint64(&cmap.stats.misses)
+	return Stats{
+		Puts:    atomic.LoadUint64(&cmap.stats.puts),
+		Gets:    hits + misses,
+		Hits:    hits,
+		Misses:  misses,
+		Deletes: atomic.LoadUint64(&cmap.stats.deletes),
+	}
+}
+
+func (cmap *myConcurrentMap) ResetStats() {
+	atomic.StoreUint64(&cmap.stats.puts, 0)
+	atomic.StoreUint64(&cmap.stats.hits, 0)
+	atomic.StoreUint64(&cmap.stats.misses, 0)
+	atomic.StoreUint64(&cmap.stats.deletes, 0)
+}
+
+// sampleLatency 判断本次读取是否需要测量耗时。
+// 计数器每次增加黄金分割比对应的常数，其取值在整个区间上均匀分布，
+// 因此小于阈值的比例趋近于采样比例，而判断本身只需一次原子加法
+func (cmap *myConcurrentMap) sampleLatency() bool {
+	if cmap.latency == nil {
+		return false
+	}
+	return atomic.AddUint64(&cmap.latencyTicks, 0x9E3779B97F4A7C15) <= cmap.latencyThreshold
+}
+
+// putDone 会记录一次成功的放入并通知观察者
+func (cmap *myConcurrentMap) putDone(inserted bool) {
+	atomic.AddUint64(&cmap.stats.puts, 1)
+	if cmap.opts.observer != nil {
+		cmap.opts.observer.OnPut(inserted)
+	}
+}
+
+// putsDone 会记录一批放入并通知观察者，其中inserted个新增了键-元素对
+func (cmap *myConcurrentMap) putsDone(puts, inserted int) {
+	atomic.AddUint64(&cmap.stats.puts, uint64(puts))
+	if cmap.opts.observer != nil {
+		for i := 0; i < puts; i++ {
+			cmap.opts.observer.OnPut(i < inserted)
+		}
+	}
+}
+
+// getDone 会记录一次读取并通知观察者
+func (cmap *myConcurrentMap) getDone(hit bool) {
+	if hit {
+		atomic.AddUint64(&cmap.stats.hits, 1)
+	} else {
+		atomic.AddUint64(&cmap.stats.misses, 1)
+	}
+	if cmap.opts.observer != nil {
+		cmap.opts.observer.OnGet(hit)
+	}
+}
+
+// deletesDone 会记录一批删除并通知观察者，其中found个键存在
+func (cmap *myConcurrentMap) deletesDone(deletes, found int) {
+	atomic.AddUint64(&cmap.stats.deletes, uint64(deletes))
+	if cmap.opts.observer != nil {
+		for i := 0; i < deletes; i++ {
+			cmap.opts.observer.OnDelete(i < found)
+		}
+	}
+}
+
+// deleteDone 会记录一次删除并通知观察者
+func (cmap *myConcurrentMap) deleteDone(found bool) {
+	atomic.AddUint64(&cmap.stats.deletes, 1)
+	if cmap.opts.observer != nil {
+		cmap.opts.observer.OnDelete(found)
+	}
+}
+
+const (
+	// pairOverheadBytes 是每个键 - 元素对的估计开销：pair结构体本身和装箱元素的接口值
+	pairOverheadBytes = uint64(unsafe.Sizeof(pair{})) + uint64(unsafe.Sizeof(interface{}(nil)))
+	// bucketOverheadBytes 是每个散列桶的估计开销：bucket结构体、散列桶列表中的接口值和互斥锁
+	bucketOverheadBytes = uint64(unsafe.Sizeof(bucket{})) + uint64(unsafe.Sizeof(Bucket(nil))) +
+		uint64(unsafe.Sizeof(sync.Mutex{}))
+)
+
+func (cmap *myConcurrentMap) ApproxMemoryBytes() uint64 {
+	var bytes uint64
+	for _, s := range cmap.segments {
+		bytes += uint64(len(s.Buckets())) * bucketOverheadBytes
+		s.Range(func(p Pair) bool {
+			bytes += pairOverheadBytes + uint64(len(p.Key()))
+			if pp, ok := p.(*pair); ok {
+				bytes += uint64(len(pp.rawKey))
+			}
+			return true
+		})
+	}
+	return bytes
+}
@@ -0,0 +1,86 @@
+package concurrentMap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SaveTo 会逐个编码键-元素对并以长度前缀的记录写入w，
+// 每条记录由uvarint编码的长度和encode返回的字节组成
+func (cmap *myConcurrentMap) SaveTo(w io.Writer, encode func(key string, element interface{}) ([]byte, error)) (int64, error) {
+	var written int64
+	var err error
+	prefix := make([]byte, binary.MaxVarintLen64)
+	cmap.Range(func(key string, element interface{}) bool {
+		var record []byte
+		if record, err = encode(key, element); err != nil {
+			return false
+		}
+		var n int
+		n, err = w.Write(prefix[:binary.PutUvarint(prefix, uint64(len(record)))])
+		written += int64(n)
+		if err != nil {
+			return false
+		}
+		n, err = w.Write(record)
+		written += int64(n)
+		return err == nil
+	})
+	return written, err
+}
+
+// countingReader 代表会统计已读取字节数的读取器。
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	c, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return c, err
+}
+
+// LoadFrom 会读取SaveTo写出的记录，逐条经decode解码后放入字典，
+// 已有的键会被覆盖。在记录边界遇到io.EOF时正常结束，
+// 不完整或无法解码的记录会返回CorruptRecordError
+func (cmap *myConcurrentMap) LoadFrom(r io.Reader, decode func(record []byte) (key string, element interface{}, err error)) (int64, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	for {
+		offset := cr.n
+		length, err := binary.ReadUvarint(cr)
+		if err == io.EOF && cr.n == offset {
+			return cr.n, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cr.n, newCorruptRecordError(offset, "truncated length prefix")
+		}
+		if err != nil {
+			return cr.n, err
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(cr, record); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cr.n, newCorruptRecordError(offset,
+				fmt.Sprintf("truncated record, expected %d bytes", length))
+		} else if err != nil {
+			return cr.n, err
+		}
+		key, element, err := decode(record)
+		if err != nil {
+			return cr.n, newCorruptRecordError(offset, err.Error())
+		}
+		if _, err := cmap.Put(key, element); err != nil {
+			return cr.n, err
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package concurrentMap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+func (cmap *myConcurrentMap) TTLRemaining(key string) (remaining time.Duration, ok bool) {
+	key = cmap.normalize(key)
+	keyHash := cmap.opts.hashFunc(key)
+	s := cmap.findSegment(keyHash)
+	s.BeginRead()
+	defer s.EndRead()
+	p := s.GetWithHash(key, keyHash)
+	now := cmap.now()
+	if p == nil || isExpired(p, now) {
+		return 0, false
+	}
+	expiration := p.Expiration()
+	if expiration == 0 {
+		return TTL_NO_EXPIRY, true
+	}
+	return time.Duration(expiration - now), true
+}
+
+func (cmap *myConcurrentMap) PutWithTTL(key string, element interface{}, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, newIllegalParameterErrorWithCause(ErrInvalidTTL, "ttl is not positive")
+	}
+	p, err := cmap.newPair(key, element)
+	if err != nil {
+		return false, err
+	}
+	p.SetExpiration(cmap.now() + int64(ttl))
+	p.(*pair).ttl = int64(ttl)
+	s := cmap.findSegment(p.Hash())
+	ok, err := s.Put(p)
+	if ok {
+		cmap.addTotal(1)
+	}
+	if err == nil {
+		cmap.putDone(ok)
+	}
+	cmap.startSweep()
+	return ok, err
+}
+
+// now 返回字典的时钟给出的当前时刻（Unix纳秒）
+func (cmap *myConcurrentMap) now() int64 {
+	return cmap.opts.clock().UnixNano()
+}
+
+// startSweep 启动后台清理协程，它在字典的生命周期内最多只会被启动一次
+func (cmap *myConcurrentMap) startSweep() {
+	cmap.sweepOnce.Do(func() {
+		go cmap.sweep(DEFAULT_SWEEP_INTERVAL)
+	})
+}
+
+// sweepIfExpiring 在p带有过期时间时启动后台清理协程，
+// 所有可能放入带过期时间的键-元素对的方法都需要调用它
+func (cmap *myConcurrentMap) sweepIfExpiring(p Pair) {
+	if p.Expiration() != 0 {
+		cmap.startSweep()
+	}
+}
+
+func (cmap *myConcurrentMap) Close() {
+	cmap.closeOnce.Do(func() {
+		close(cmap.closeCh)
+	})
+}
+
+// sweep 会周期性地删除所有已过期的键-元素对，直到字典被关闭
+func (cmap *myConcurrentMap) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cmap.closeCh:
+			return
+		case <-ticker.C:
+			cmap.deleteAllExpired(cmap.now())
+		}
+	}
+}
+
+// deleteAllExpired 删除所有在给定时刻已过期的键-元素对
+func (cmap *myConcurrentMap) deleteAllExpired(now int64) {
+	for _, s := range cmap.segments {
+		if count := s.DeleteExpired(now); count > 0 {
+			atomic.AddUint64(&cmap.total, ^(count - 1))
+		}
+	}
+}
+
+// deleteExpired 在键对应的键-元素对已过期时删除它
+func (cmap *myConcurrentMap) deleteExpired(s Segment, key string, keyHash uint64) {
+	if s.DeleteIf(key, keyHash, func(p Pair) bool {
+		return isExpired(p, cmap.now())
+	}) {
+		atomic.AddUint64(&cmap.total, ^uint64(0))
+	}
+}
@@ -0,0 +1,120 @@
+package concurrentMap
+
+import "sort"
+
+// Tx 代表Transaction中的一个事务，它的写操作会被缓存，直到事务提交时才被应用。
+// Tx只能在传给Transaction的函数中使用，并且不能被并发调用。
+type Tx interface {
+	// Get 返回键对应的元素，事务中已写入或删除的键以事务中的结果为准，
+	// 其他键读取的是字典当前的内容，不会被锁定
+	Get(key string) (element interface{}, ok bool)
+	// Put 在事务中放入键-元素对
+	Put(key string, element interface{})
+	// Delete 在事务中删除键
+	Delete(key string)
+}
+
+// txWrite 代表事务中对一个键的最后一次写操作。
+type txWrite struct {
+	// 调用方给出的原始键
+	key     string
+	element interface{}
+	delete  bool
+}
+
+// transaction 是Tx的实现类型。
+type transaction struct {
+	cmap *myConcurrentMap
+	// 规范化之后的键到最后一次写操作的映射
+	writes map[string]txWrite
+	// 规范化之后的键按首次写入的顺序排列，提交时按此顺序应用
+	order []string
+}
+
+func (tx *transaction) Get(key string) (element interface{}, ok bool) {
+	if w, found := tx.writes[tx.cmap.normalize(key)]; found {
+		if w.delete {
+			return nil, false
+		}
+		return w.element, true
+	}
+	return tx.cmap.Load(key)
+}
+
+func (tx *transaction) Put(key string, element interface{}) {
+	tx.write(txWrite{key: key, element: element})
+}
+
+func (tx *transaction) Delete(key string) {
+	tx.write(txWrite{key: key, delete: true})
+}
+
+// write 会记录一次写操作，同一个键的后一次写操作会取代前一次
+func (tx *transaction) write(w txWrite) {
+	normalized := tx.cmap.normalize(w.key)
+	if _, ok := tx.writes[normalized]; !ok {
+		tx.order = append(tx.order, normalized)
+	}
+	tx.writes[normalized] = w
+}
+
+func (cmap *myConcurrentMap) Transaction(fn func(tx Tx) error) error {
+	tx := &transaction{cmap: cmap, writes: make(map[string]txWrite)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.order) == 0 {
+		return nil
+	}
+	var indexes []int
+	locked := make(map[int]bool)
+	for _, key := range tx.order {
+		if index := cmap.segmentIndex(cmap.opts.hashFunc(key)); !locked[index] {
+			locked[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		cmap.segments[index].Lock()
+	}
+	delta, err := cmap.commitLocked(indexes, tx)
+	cmap.addTotal(delta)
+	return err
+}
+
+// commitLocked 在已经持有indexes中全部散列段写锁的情况下应用事务的写操作，
+// 返回前会按相反的顺序释放这些锁。delta为键-元素对总数的变化量
+func (cmap *myConcurrentMap) commitLocked(indexes []int, tx *transaction) (delta int, err error) {
+	defer func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			cmap.segments[indexes[i]].Unlock()
+		}
+	}()
+	for _, key := range tx.order {
+		w := tx.writes[key]
+		keyHash := cmap.opts.hashFunc(key)
+		s := cmap.findSegment(keyHash)
+		if w.delete {
+			found := s.DeleteLocked(key, keyHash)
+			if found {
+				delta--
+			}
+			cmap.deleteDone(found)
+			continue
+		}
+		var p Pair
+		if p, err = cmap.newPair(w.key, w.element); err != nil {
+			return delta, err
+		}
+		var isNew bool
+		if isNew, err = s.PutLocked(p); err != nil {
+			return delta, err
+		}
+		if isNew {
+			delta++
+		}
+		cmap.putDone(isNew)
+	}
+	return delta, nil
+}
@@ -0,0 +1,51 @@
+package concurrentMap
+
+// TypedMap 代表元素类型固定为V的并发安全字典，
+// 它委托给ConcurrentMap并在存取时完成元素的装箱与拆箱。
+type TypedMap[V any] struct {
+	cmap ConcurrentMap
+}
+
+// NewTypedMap 会创建一个TypedMap类型的实例。
+func NewTypedMap[V any](concurrency int, pairRedistributor PairRedistributor) (*TypedMap[V], error) {
+	cmap, err := NewConcurrentMap(concurrency, pairRedistributor)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedMap[V]{cmap: cmap}, nil
+}
+
+// Get 返回键对应的元素。
+// 键不存在或已存元素的类型不是V时返回V的零值和false。
+func (tm *TypedMap[V]) Get(key string) (V, bool) {
+	var zero V
+	element, ok := tm.cmap.Load(key)
+	if !ok {
+		return zero, false
+	}
+	// 只有V是接口类型时nil才是合法的V
+	if element == nil {
+		return zero, interface{}(zero) == nil
+	}
+	v, ok := element.(V)
+	if !ok {
+		return zero, false
+	}
+	return v, true
+}
+
+// Put 放入一个键-元素对。
+func (tm *TypedMap[V]) Put(key string, v V) error {
+	_, err := tm.cmap.Put(key, v)
+	return err
+}
+
+// Delete 删除键对应的键-元素对。
+func (tm *TypedMap[V]) Delete(key string) bool {
+	return tm.cmap.Delete(key)
+}
+
+// Len 返回键-元素对的总数。
+func (tm *TypedMap[V]) Len() uint64 {
+	return tm.cmap.Len()
+}
@@ -0,0 +1,86 @@
+package concurrentMap
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// waiter 代表一个正在等待键被放入的WaitFor调用。
+type waiter struct {
+	// 容量为1，放入的元素会被非阻塞地发送给它
+	ch chan interface{}
+}
+
+// waiterSet 记录每个键上正在等待的WaitFor调用，它作为散列段的监听器使用。
+// 没有任何等待者时事件只需一次原子读取即可跳过。
+type waiterSet struct {
+	lock    sync.Mutex
+	waiters map[string]map[*waiter]struct{}
+	count   int32
+}
+
+// newWaiterSet 会创建一个waiterSet类型的实例。
+func newWaiterSet() *waiterSet {
+	return &waiterSet{waiters: make(map[string]map[*waiter]struct{})}
+}
+
+func (ws *waiterSet) pairStored(key string, element interface{}) {
+	if atomic.LoadInt32(&ws.count) == 0 {
+		return
+	}
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for w := range ws.waiters[key] {
+		w.ch <- element
+	}
+	atomic.AddInt32(&ws.count, -int32(len(ws.waiters[key])))
+	delete(ws.waiters, key)
+}
+
+func (ws *waiterSet) pairRemoved(key string) {}
+
+// add 会在key上登记一个新的等待者
+func (ws *waiterSet) add(key string) *waiter {
+	w := &waiter{ch: make(chan interface{}, 1)}
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.waiters[key] == nil {
+		ws.waiters[key] = make(map[*waiter]struct{})
+	}
+	ws.waiters[key][w] = struct{}{}
+	atomic.AddInt32(&ws.count, 1)
+	return w
+}
+
+// remove 会撤销key上尚未被唤醒的等待者，已被唤醒的等待者会被忽略
+func (ws *waiterSet) remove(key string, w *waiter) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	waiters := ws.waiters[key]
+	if _, ok := waiters[w]; !ok {
+		return
+	}
+	delete(waiters, w)
+	if len(waiters) == 0 {
+		delete(ws.waiters, key)
+	}
+	atomic.AddInt32(&ws.count, -1)
+}
+
+func (cmap *myConcurrentMap) WaitFor(ctx context.Context, key string) (interface{}, error) {
+	normalized := cmap.normalize(key)
+	// 先登记再查找，这样在两者之间发生的放入也会唤醒等待者
+	w := cmap.waiters.add(normalized)
+	if element, ok := cmap.Load(key); ok {
+		cmap.waiters.remove(normalized, w)
+		return element, nil
+	}
+	select {
+	case element := <-w.ch:
+		return cmap.copyValue(element), nil
+	case <-ctx.Done():
+		cmap.waiters.remove(normalized, w)
+		return nil, ctx.Err()
+	}
+}